@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"flag"
 	"log"
 	"math/rand"
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -22,11 +26,14 @@ func main() {
 	rand.Seed(time.Now().UnixNano())
 
 	listen := flag.String("listen", "<proto>://<ip>:<port begin-end>[,...] eg. udp://0.0.0.0:500", "listen to")
-	upstream := flag.String("upstream", "<proto>://<ip>:<port begin-end>[,...] eg. udp://172.0.0.1:2000-2100,192.168.1.1:2000-2050", "send to")
+	upstream := flag.String("upstream", "<proto>://<ip>:<port begin-end>[+...][?weight=&group=&bind=][,...] eg. udp://172.0.0.1:2000-2100,udp://[2001:db8::1]:2000-2050+3000?group=isp-b", "send to")
 	role := flag.String("role", "frontend", "work as backend or frontend")
 	loglevel := flag.Bool("v", false, "set log level to debug")
 	pprof := flag.String("pprof", "", "pprof listen to")
 	logfile := flag.String("log", "", "output log to file")
+	config := flag.String("config", "", "read listen and upstream from file, reloaded on SIGHUP")
+	scheduler := flag.String("scheduler", "redundant", "pick upstreams by redundant, bonding, roundrobin, minrtt, weighted or redundant-<n>")
+	key := flag.String("key", "", "key shared by frontend and backend to sign pings, backend follows address change of udp upstreams only if it's set")
 
 	flag.Parse()
 
@@ -49,13 +56,31 @@ func main() {
 		}()
 	}
 
+	if len(*config) != 0 {
+		if err := loadConfig(*config, listen, upstream); err != nil {
+			logrus.Fatalln("load config file failed", err)
+		}
+	}
+
 	var t trafcacc.Trafcacc
+	var err error
 	switch *role {
 	case "backend":
-		t = trafcacc.Accelerate(*listen, *upstream, trafcacc.BACKEND)
+		t, err = trafcacc.Accelerate(*listen, *upstream, trafcacc.BACKEND)
 	default:
-		t = trafcacc.Accelerate(*listen, *upstream, trafcacc.FRONTEND)
+		t, err = trafcacc.Accelerate(*listen, *upstream, trafcacc.FRONTEND)
+	}
+	if err != nil {
+		logrus.Fatalln("accelerate failed", err)
 	}
+
+	s, err := newScheduler(*scheduler)
+	if err != nil {
+		logrus.Fatalln("unknown scheduler", *scheduler, err)
+	}
+	t.SetScheduler(s)
+	t.SetKey([]byte(*key))
+
 	t.WaitforAlive()
 
 	if len(*pprof) != 0 {
@@ -74,8 +99,77 @@ func main() {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	signal.Notify(c, syscall.SIGTERM)
+	signal.Notify(c, syscall.SIGHUP)
 
-	<-c
+	for sig := range c {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if len(*config) == 0 {
+			logrus.Warnln("SIGHUP received without -config, nothing to reload")
+			continue
+		}
+		if err := loadConfig(*config, listen, upstream); err != nil {
+			logrus.WithError(err).Errorln("reload config file failed")
+			continue
+		}
+		if err := t.Reload(*listen, *upstream); err != nil {
+			logrus.WithError(err).Errorln("reload failed")
+		}
+	}
 	// cleanup
 	os.Exit(0)
 }
+
+func newScheduler(name string) (trafcacc.Scheduler, error) {
+	switch name {
+	case "redundant":
+		return trafcacc.NewRedundantScheduler(), nil
+	case "bonding":
+		return trafcacc.NewBondingScheduler(), nil
+	case "roundrobin":
+		return trafcacc.NewRoundRobinScheduler(), nil
+	case "minrtt":
+		return trafcacc.NewMinRTTScheduler(), nil
+	case "weighted":
+		return trafcacc.NewWeightedRandomScheduler(), nil
+	}
+	if strings.HasPrefix(name, "redundant-") {
+		n, err := strconv.Atoi(strings.TrimPrefix(name, "redundant-"))
+		if err != nil {
+			return nil, err
+		}
+		return trafcacc.NewRedundantNScheduler(n), nil
+	}
+	return nil, errors.New("no such scheduler")
+}
+
+// loadConfig read "listen=" and "upstream=" lines from file, lines start
+// with # are ignored
+func loadConfig(file string, listen, upstream *string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		x := strings.SplitN(strings.TrimLeft(line, "-"), "=", 2)
+		if len(x) < 2 {
+			continue
+		}
+		v := strings.TrimSpace(x[1])
+		switch strings.TrimSpace(x[0]) {
+		case "listen":
+			*listen = v
+		case "upstream":
+			*upstream = v
+		}
+	}
+	return scanner.Err()
+}
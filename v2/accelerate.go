@@ -3,20 +3,24 @@ package trafcacc
 import (
 	"io"
 	"net"
-	"strconv"
 	"sync"
 
 	"github.com/Sirupsen/logrus"
 )
 
 // Accelerate traffic by setup front-end dialer and back-end server
-func Accelerate(l, u string, role tag) Trafcacc {
+func Accelerate(l, u string, role tag) (Trafcacc, error) {
 	t := &trafcacc{
-		role: role,
-		Cond: sync.NewCond(&sync.Mutex{}),
+		role:      role,
+		Cond:      sync.NewCond(&sync.Mutex{}),
+		listeners: make(map[string]net.Listener),
 	}
-	t.accelerate(l, u)
-	return t
+	if err := t.accelerate(l, u); err != nil {
+		// roll back listeners and upstreams that are already set up
+		t.Close()
+		return nil, err
+	}
+	return t, nil
 }
 
 // tag is type of role: BACKEND or FRONTEND
@@ -33,18 +37,33 @@ type trafcacc struct {
 	alive  bool
 	role   tag
 	remote *upstream
-	pool   *streampool
 	pconn  pconn
+
+	// backend only
+	serve *serve
+
+	// frontend only
+	dialer    *dialer
+	lmux      sync.Mutex
+	listeners map[string]net.Listener
 }
 
 // Trafcacc give a interface to query running status
 type Trafcacc interface {
 	Status()
 	WaitforAlive()
+	Reload(l, u string) error
+	SetScheduler(Scheduler)
+	SetKey([]byte)
+	Close() error
 }
 
 func (t *trafcacc) Serve(conn net.Conn) {
-	uc, err := net.Dial(t.remote.proto, t.remote.addr)
+	t.L.Lock()
+	remote := t.remote
+	t.L.Unlock()
+
+	uc, err := remote.dial()
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"error": err,
@@ -59,25 +78,20 @@ func (t *trafcacc) Serve(conn net.Conn) {
 }
 
 // Accelerate traffic by listen to l, and connect to u
-func (t *trafcacc) accelerate(l, u string) {
+func (t *trafcacc) accelerate(l, u string) error {
 	switch t.role {
 	case BACKEND:
 		// TODO: setup trafcacc.Server to listen to and HandleFunc from l
 		// connect to upstream
-		for _, e := range parse(u) {
-			for p := e.portBegin; p <= e.portEnd; p++ {
-				t.remote = newUpstream(e.proto)
-				t.remote.addr = net.JoinHostPort(e.host, strconv.Itoa(p))
-				break
-			}
-		}
-		if t.remote == nil {
-			logrus.Fatalln("didn't specify remote addr for backend")
+		if err := t.setremote(u); err != nil {
+			return err
 		}
 		serve := newServe()
-		serve.Handle(l, t)
-		t.pool = serve.pool
+		t.serve = serve
 		t.pconn = serve
+		if err := serve.Handle(l, t); err != nil {
+			return err
+		}
 		go func() {
 			serve.waitforalive()
 			t.setalive()
@@ -87,40 +101,156 @@ func (t *trafcacc) accelerate(l, u string) {
 		// TODO: listen to l
 		// use trafcacc.Dialer to init connection to u
 		dialer := newDialer()
-		dialer.Setup(u)
-		t.pool = dialer.streampool()
+		t.dialer = dialer
 		t.pconn = dialer
+		if err := dialer.Setup(u); err != nil {
+			return err
+		}
+
+		return t.listen(l)
+	}
+	return nil
+}
+
+// Reload listen to l and connect to u in place of the previous settings,
+// tunneled connections that are already established survive the reload
+func (t *trafcacc) Reload(l, u string) (err error) {
+	switch t.role {
+	case BACKEND:
+		if err = t.setremote(u); err != nil {
+			return err
+		}
+		err = t.serve.Reload(l)
+	case FRONTEND:
+		if err = t.dialer.Reload(u); err != nil {
+			return err
+		}
+		err = t.listen(l)
+	}
+	logrus.WithFields(logrus.Fields{
+		"listen":   l,
+		"upstream": u,
+		"error":    err,
+	}).Infoln(t.roleString(), "reloaded")
+	return err
+}
+
+// Close stops t, listeners and upstreams are closed at once. Tunneled
+// connections are broken.
+func (t *trafcacc) Close() error {
+	t.lmux.Lock()
+	for key, ln := range t.listeners {
+		delete(t.listeners, key)
+		ln.Close()
+	}
+	t.lmux.Unlock()
+
+	switch t.role {
+	case BACKEND:
+		if t.serve != nil {
+			return t.serve.Close()
+		}
+	case FRONTEND:
+		if t.dialer != nil {
+			return t.dialer.Close()
+		}
+	}
+	return nil
+}
 
-		for _, e := range parse(l) {
-			for p := e.portBegin; p <= e.portEnd; p++ {
-				ln, err := net.Listen(e.proto, net.JoinHostPort(e.host, strconv.Itoa(p)))
-				if err != nil {
-					// handle error
-					logrus.WithFields(logrus.Fields{
-						"error":    err,
-						"endpoint": e,
-					}).Fatalln("frontend listen to address error")
+// SetScheduler set the policy of picking upstreams for packets
+func (t *trafcacc) SetScheduler(s Scheduler) {
+	t.pconn.SetScheduler(s)
+}
+
+// SetKey set the key shared by frontend and backend to sign pings
+func (t *trafcacc) SetKey(key []byte) {
+	t.pconn.SetKey(key)
+}
+
+func (t *trafcacc) setremote(u string) error {
+	endpoints, err := ParseEndpoints(u)
+	if err != nil {
+		return err
+	}
+	var remote *upstream
+	for _, e := range endpoints {
+		remote = newUpstream(e.Proto)
+		remote.addr = e.Addrs()[0]
+		remote.bind = e.Bind
+	}
+	if remote == nil {
+		return &ParseError{Arg: u, Msg: "didn't specify remote addr for backend"}
+	}
+	t.L.Lock()
+	t.remote = remote
+	t.L.Unlock()
+	return nil
+}
+
+// listen to every address of l as frontend, close listeners that are no
+// longer in l. The first bind error is returned after the rest of l has been
+// applied.
+func (t *trafcacc) listen(l string) (err error) {
+	endpoints, err := ParseEndpoints(l)
+	if err != nil {
+		return err
+	}
+
+	t.lmux.Lock()
+	defer t.lmux.Unlock()
+
+	listed := make(map[string]bool)
+	for _, e := range endpoints {
+		for _, addr := range e.Addrs() {
+			key := e.Proto + "://" + addr
+			listed[key] = true
+			if _, exist := t.listeners[key]; exist {
+				continue
+			}
+			ln, lerr := net.Listen(e.Proto, addr)
+			if lerr != nil {
+				logrus.WithFields(logrus.Fields{
+					"error":    lerr,
+					"endpoint": e,
+				}).Errorln("frontend listen to address error")
+				if err == nil {
+					err = &BindError{Proto: e.Proto, Addr: addr, Err: lerr}
 				}
-				t.setalive()
-				go acceptTCP(ln, func(conn net.Conn) {
-					up, err := dialer.Dial()
-					if err != nil {
-						// handle error
-						logrus.WithFields(logrus.Fields{
-							"error": err,
-						}).Fatalln("frontend dial to address error")
-					}
-
-					var wg sync.WaitGroup
-					go pipe(conn, up, wg)
-					go pipe(up, conn, wg)
-					wg.Wait()
-				})
-				break
+				continue
 			}
+			t.listeners[key] = ln
+			t.setalive()
+			go acceptTCP(ln, t.forward)
 		}
+	}
 
+	for key, ln := range t.listeners {
+		if !listed[key] {
+			delete(t.listeners, key)
+			logrus.WithField("listen", key).Infoln("frontend stop listen")
+			ln.Close()
+		}
 	}
+	return err
+}
+
+// forward conn accepted by frontend through dialer
+func (t *trafcacc) forward(conn net.Conn) {
+	up, err := t.dialer.Dial()
+	if err != nil {
+		// handle error
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Errorln("frontend dial to address error")
+		conn.Close()
+		return
+	}
+
+	var wg sync.WaitGroup
+	go pipe(conn, up, wg)
+	go pipe(up, conn, wg)
+	wg.Wait()
 }
 
 func (t *trafcacc) WaitforAlive() {
@@ -0,0 +1,178 @@
+package trafcacc
+
+import (
+	"errors"
+	"net"
+	"runtime"
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var errEncode = errors.New("packet encode error")
+
+// batchconn reads and writes udp packets in batches, by recvmmsg and
+// sendmmsg on linux. Elsewhere it's a packet per call.
+type batchconn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+func newBatchConn(c *net.UDPConn) batchconn {
+	if runtime.GOOS != "linux" {
+		return singleconn{c}
+	}
+	if addr, ok := c.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		return ipv6.NewPacketConn(c)
+	}
+	return ipv4.NewPacketConn(c)
+}
+
+// singleconn is batchconn that reads and writes one packet per call
+type singleconn struct {
+	*net.UDPConn
+}
+
+func (c singleconn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	n, addr, err := c.ReadFromUDP(ms[0].Buffers[0])
+	if err != nil {
+		return 0, err
+	}
+	ms[0].N, ms[0].Addr = n, addr
+	return 1, nil
+}
+
+func (c singleconn) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	for i := range ms {
+		var err error
+		if ms[i].Addr != nil {
+			_, err = c.WriteTo(ms[i].Buffers[0], ms[i].Addr)
+		} else {
+			_, err = c.Write(ms[i].Buffers[0])
+		}
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(ms), nil
+}
+
+// batchreader reads udp packets in batches into pooled packets
+type batchreader struct {
+	conn batchconn
+	ms   []ipv4.Message
+	ps   []*packet
+}
+
+func newBatchReader(c batchconn) *batchreader {
+	r := &batchreader{
+		conn: c,
+		ms:   make([]ipv4.Message, udpbatch),
+		ps:   make([]*packet, udpbatch),
+	}
+	for i := range r.ms {
+		r.ms[i].Buffers = make([][]byte, 1)
+	}
+	return r
+}
+
+// read a batch of packets, f is called with each of them and the address
+// it's from, Buf of the packet is what is read. f holds the packet.
+func (r *batchreader) read(f func(p *packet, addr *net.UDPAddr)) error {
+	for i, p := range r.ps {
+		if p == nil {
+			p = newPooledPacket()
+			r.ps[i] = p
+		}
+		r.ms[i].Buffers[0] = p.Buf
+	}
+
+	n, err := r.conn.ReadBatch(r.ms, 0)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		p := r.ps[i]
+		r.ps[i] = nil
+		p.Buf = p.Buf[:r.ms[i].N]
+		addr, _ := r.ms[i].Addr.(*net.UDPAddr)
+		f(p, addr)
+	}
+	return nil
+}
+
+// close releases packets that are not read
+func (r *batchreader) close() {
+	for i, p := range r.ps {
+		if p != nil {
+			p.release()
+			r.ps[i] = nil
+		}
+	}
+}
+
+// sendbatch writes rs on udp upstream u in as few calls as it can, returns
+// the number of packets written before error. Without batchconn, eg. conn
+// of u is not udp, packets are sent one by one.
+func (u *upstream) sendbatch(rs []sendreq) (int, error) {
+	u.cmux.Lock()
+	batch := u.batch
+	u.cmux.Unlock()
+	if batch == nil {
+		for i, r := range rs {
+			if err := u.sendpacket(r.p); err != nil {
+				return i, err
+			}
+		}
+		return len(rs), nil
+	}
+
+	if u.ms == nil {
+		u.ms = make([]ipv4.Message, udpbatch)
+		for i := range u.ms {
+			u.ms[i].Buffers = make([][]byte, 1)
+		}
+	}
+
+	var addr net.Addr
+	if a, ok := u.udpaddr.Load().(*net.UDPAddr); ok { // server
+		addr = a
+	}
+
+	var bufs [udpbatch]*[]byte
+	defer func() {
+		for _, b := range bufs {
+			if b != nil {
+				putbuf(b)
+			}
+		}
+	}()
+
+	var err error
+	ms := u.ms[:0]
+	for i, r := range rs {
+		bufs[i] = getbuf()
+		n := r.p.encode(*bufs[i])
+		if n < 0 {
+			err = errEncode
+			break
+		}
+		ms = u.ms[:i+1]
+		ms[i].Buffers[0] = (*bufs[i])[:n]
+		ms[i].Addr = addr
+	}
+
+	var n int
+	for n < len(ms) {
+		m, werr := batch.WriteBatch(ms[n:], 0)
+		for _, r := range rs[n : n+m] {
+			atomic.AddUint64(&u.sent, uint64(len(r.p.Buf)))
+		}
+		n += m
+		if werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,67 @@
+package trafcacc
+
+import (
+	"net"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	l, err := net.ListenUDP(udp, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.DialUDP(udp, nil, l.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, batch := range []batchconn{newBatchConn(l), singleconn{l}} {
+		// server upstream writes to the address of peer
+		u := newUpstream(udp)
+		u.udpconn = l
+		u.batch = batch
+		u.udpaddr.Store(conn.LocalAddr())
+
+		var rs []sendreq
+		for i := 1; i <= 3; i++ {
+			p := newPooledPacket()
+			p.Seqid = uint32(i)
+			p.Buf = p.Buf[:i*100]
+			rs = append(rs, sendreq{p: p})
+		}
+		if n, err := u.sendbatch(rs); n != len(rs) || err != nil {
+			t.Fatal("expect batch written", n, err)
+		}
+
+		r := newBatchReader(newBatchConn(conn))
+		var got []*packet
+		for len(got) < len(rs) {
+			err := r.read(func(p *packet, addr *net.UDPAddr) {
+				if addr.Port != l.LocalAddr().(*net.UDPAddr).Port {
+					t.Fatal("expect packet from listener", addr)
+				}
+				if err := decodePacket(p.Buf, p); err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, p)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		r.close()
+
+		for i, p := range got {
+			if p.Seqid != rs[i].p.Seqid || len(p.Buf) != len(rs[i].p.Buf) {
+				t.Fatal("expect packets read in order", p.Seqid, len(p.Buf))
+			}
+			p.release()
+			rs[i].p.release()
+		}
+		if u.sent != 600 {
+			t.Fatal("expect bytes sent counted", u.sent)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package trafcacc
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// circuit breaker states of upstream
+const (
+	breakerClosed   int32 = iota // picked as usual
+	breakerOpen                  // quarantined, not picked
+	breakerHalfOpen              // not picked, but sent trial copies of packets
+)
+
+var breakerNames = []string{"closed", "open", "half-open"}
+
+// breaker of upstream is tripped open by breakerfails send errors in a row or
+// by loss above breakerloss. It's half-open after wait, and closed again
+// after breakertrials trial sends succeed. wait doubles every time it's
+// tripped again before closed.
+type breaker struct {
+	mux       sync.Mutex
+	state     int32
+	fails     int
+	trials    int
+	opened    time.Time
+	wait      time.Duration
+	nexttrial int64
+	reason    string
+}
+
+func (b *breaker) current() int32 {
+	return atomic.LoadInt32(&b.state)
+}
+
+// String returns the state and the reason it's tripped
+func (b *breaker) String() string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	s := breakerNames[b.state]
+	if b.state != breakerClosed {
+		s += "(" + b.reason + ")"
+	}
+	return s
+}
+
+// record result of a send, returns true if the state is changed
+func (b *breaker) record(u *upstream, err error) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	switch b.state {
+	case breakerClosed:
+		if err == nil {
+			b.fails = 0
+			return false
+		}
+		if b.fails++; b.fails >= breakerfails {
+			b.trip(u, "send error: "+err.Error())
+			return true
+		}
+	case breakerHalfOpen:
+		if err != nil {
+			b.trip(u, "trial error: "+err.Error())
+			return true
+		}
+		if b.trials++; b.trials >= breakertrials {
+			b.reset(u)
+			return true
+		}
+	}
+	return false
+}
+
+// check loss of u and wait of open breaker, it's called by updateloop
+func (b *breaker) check(u *upstream) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	lossy := u.lossMeasured() && u.LossOut() >= breakerloss
+	switch b.state {
+	case breakerClosed:
+		if lossy {
+			b.trip(u, "loss")
+		}
+	case breakerOpen:
+		if time.Since(b.opened) >= b.wait {
+			b.trials = 0
+			atomic.StoreInt32(&b.state, breakerHalfOpen)
+			logrus.WithFields(logrus.Fields{
+				"proto": u.proto,
+				"addr":  u.addr,
+			}).Infoln("upstream breaker half-open")
+		}
+	case breakerHalfOpen:
+		if lossy {
+			b.trip(u, "loss")
+		}
+	}
+}
+
+// trytrial returns true if a trial copy is due on half-open breaker
+func (b *breaker) trytrial() bool {
+	if b.current() != breakerHalfOpen {
+		return false
+	}
+	now := time.Now().UnixNano()
+	next := atomic.LoadInt64(&b.nexttrial)
+	return now >= next && atomic.CompareAndSwapInt64(&b.nexttrial, next, now+int64(breakertrialinterval))
+}
+
+func (b *breaker) trip(u *upstream, reason string) {
+	if b.state == breakerClosed {
+		b.wait = breakermin
+	} else {
+		b.wait *= 2
+		if b.wait > breakermax {
+			b.wait = breakermax
+		}
+	}
+	b.fails, b.trials = 0, 0
+	b.opened = time.Now()
+	b.reason = reason
+	atomic.StoreInt32(&b.state, breakerOpen)
+	logrus.WithFields(logrus.Fields{
+		"proto":  u.proto,
+		"addr":   u.addr,
+		"reason": reason,
+		"wait":   b.wait,
+	}).Warnln("upstream breaker open")
+}
+
+func (b *breaker) reset(u *upstream) {
+	b.fails, b.trials = 0, 0
+	b.reason = ""
+	atomic.StoreInt32(&b.state, breakerClosed)
+	logrus.WithFields(logrus.Fields{
+		"proto": u.proto,
+		"addr":  u.addr,
+	}).Infoln("upstream breaker closed")
+}
@@ -0,0 +1,58 @@
+package trafcacc
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	bad := testUpstream(udp, 1)
+	good := testUpstream(udp, 2)
+	pool := testPool(bad, good)
+
+	senderr := errors.New("send error")
+	for i := 0; i < breakerfails; i++ {
+		bad.brk.record(bad, senderr)
+	}
+	if bad.brk.current() != breakerOpen {
+		t.Fatal("expect breaker open after send errors", bad.brk.String())
+	}
+	pool.updatealive()
+	for i := 0; i < 10; i++ {
+		if ups := pool.pickupstreams(&packet{}); len(ups) != 1 || ups[0] != good {
+			t.Fatal("expect open upstream excluded")
+		}
+	}
+	if len(pool.picktrials()) != 0 {
+		t.Fatal("expect no trial on open upstream")
+	}
+
+	// half-open after wait, trial copies are sent on schedule
+	bad.brk.opened = time.Now().Add(-breakermin)
+	pool.updatealive()
+	if bad.brk.current() != breakerHalfOpen {
+		t.Fatal("expect breaker half-open", bad.brk.String())
+	}
+	if ups := pool.picktrials(); len(ups) != 1 || ups[0] != bad {
+		t.Fatal("expect trial on half-open upstream")
+	}
+	if len(pool.picktrials()) != 0 {
+		t.Fatal("expect one trial per", breakertrialinterval)
+	}
+
+	// failed trial trips it again for longer
+	bad.brk.record(bad, senderr)
+	if bad.brk.current() != breakerOpen || bad.brk.wait != breakermin*2 {
+		t.Fatal("expect breaker open again with doubled wait", bad.brk.wait)
+	}
+
+	bad.brk.opened = time.Now().Add(-bad.brk.wait)
+	pool.updatealive()
+	for i := 0; i < breakertrials; i++ {
+		bad.brk.record(bad, nil)
+	}
+	if bad.brk.current() != breakerClosed {
+		t.Fatal("expect breaker closed after trials", bad.brk.String())
+	}
+}
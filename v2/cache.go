@@ -1,44 +1,100 @@
 package trafcacc
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 type connCache struct {
 	sync.RWMutex
-	seqence map[uint32]*packet
-	lastack uint32
+	seqence ring   // base of it is the one after the last acked
+	top     uint32 // the highest seqid cached
+	window  uint32 // the highest seqid that peer accepts
+	size    int64  // bytes cached
+	closed  bool
 }
 
+// writeCache keeps data packets sent until they are acked, so that they can
+// be sent again on request. It holds up to cacheconn bytes per connection
+// and cacheall bytes in total, add blocks until acks free space or open
+// window of peer. Connections are held in connshards shards by key.
 type writeCache struct {
+	shards [connshards]cacheShard
+	size   int64 // bytes cached
+
+	// add waits on full for acks
+	full *sync.Cond
+}
+
+type cacheShard struct {
 	sync.RWMutex
 	conns map[uint64]*connCache
 }
 
 func newWriteCache() *writeCache {
-	return &writeCache{conns: make(map[uint64]*connCache)}
+	c := &writeCache{
+		full: sync.NewCond(&sync.Mutex{}),
+	}
+	for i := range c.shards {
+		c.shards[i].conns = make(map[uint64]*connCache)
+	}
+	return c
 }
 
+func (c *writeCache) shard(key uint64) *cacheShard {
+	return &c.shards[key%connshards]
+}
+
+// conn returns the cache of connection, nil if there is none
+func (c *writeCache) conn(senderid, connid uint32) *connCache {
+	key := packetKey(senderid, connid)
+	sh := c.shard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	return sh.conns[key]
+}
+
+// add p to the cache, it blocks while p is beyond window of peer, or the
+// cache of the connection or the whole cache is over budget. A connection
+// that has nothing cached can always add one packet in window.
 func (c *writeCache) add(p *packet) {
 	if p.Buf == nil {
 		return
 	}
 
 	key := packetKey(p.Senderid, p.Connid)
+	sh := c.shard(key)
 
-	c.Lock()
-	cn, exist := c.conns[key]
+	sh.Lock()
+	cn, exist := sh.conns[key]
 	if !exist {
 		// TODO: only create when connect or conected
 		cn = &connCache{
-			seqence: make(map[uint32]*packet),
+			seqence: newRing(1),
+			window:  recvwindow,
 		}
-		c.conns[key] = cn
+		sh.conns[key] = cn
+	}
+	sh.Unlock()
+
+	c.full.L.Lock()
+	for c.over(cn, p.Seqid) {
+		c.full.Wait()
 	}
-	c.Unlock()
+	c.full.L.Unlock()
 
 	cn.Lock()
-	if p.Seqid > cn.lastack {
-		if _, ok := cn.seqence[p.Seqid]; !ok {
-			cn.seqence[p.Seqid] = p
+	if !cn.closed && cn.seqence.get(p.Seqid) == nil {
+		// it's sent once cached
+		p.sent = time.Now().UnixNano()
+		if cn.seqence.put(p) {
+			p.hold()
+			if p.Seqid > cn.top {
+				cn.top = p.Seqid
+			}
+			cn.size += int64(len(p.Buf))
+			atomic.AddInt64(&c.size, int64(len(p.Buf)))
 		}
 	}
 	cn.Unlock()
@@ -46,55 +102,136 @@ func (c *writeCache) add(p *packet) {
 	return
 }
 
-func (c *writeCache) get(senderid, connid, seqid uint32) *packet {
-	key := packetKey(senderid, connid)
+// over returns true if seqid is beyond window of cn, or cn or the whole
+// cache is over budget
+func (c *writeCache) over(cn *connCache, seqid uint32) bool {
+	cn.RLock()
+	size, window, closed := cn.size, cn.window, cn.closed
+	cn.RUnlock()
+	if closed {
+		return false
+	}
+	return seqid > window ||
+		size > 0 && (size >= cacheconn || atomic.LoadInt64(&c.size) >= cacheall)
+}
 
-	c.RLock()
-	cn, exist := c.conns[key]
-	c.RUnlock()
-	if !exist {
+// free n bytes of the cache and wake up the blocked add
+func (c *writeCache) free(n int64) {
+	atomic.AddInt64(&c.size, -n)
+	c.full.L.Lock()
+	c.full.Broadcast()
+	c.full.L.Unlock()
+}
+
+// get returns the packet cached, it's held for the caller
+func (c *writeCache) get(senderid, connid, seqid uint32) *packet {
+	cn := c.conn(senderid, connid)
+	if cn == nil {
 		return nil
 	}
 
+	cn.RLock()
+	defer cn.RUnlock()
+	p := cn.seqence.get(seqid)
+	if p != nil {
+		p.hold()
+	}
+	return p
+}
+
+// ack removes packets up to seqid, and opens window of peer up to window
+func (c *writeCache) ack(senderid, connid, seqid, window uint32) {
+	cn := c.conn(senderid, connid)
+	if cn == nil {
+		return
+	}
+
 	cn.Lock()
-	defer cn.Unlock()
-	return cn.seqence[seqid]
+	var freed int64
+	cn.seqence.advance(seqid+1, func(p *packet) {
+		freed += int64(len(p.Buf))
+		p.release()
+	})
+	cn.size -= freed
+	opened := window > cn.window
+	if opened {
+		cn.window = window
+	}
+	cn.Unlock()
+
+	if freed > 0 || opened {
+		c.free(freed)
+	}
 }
 
-func (c *writeCache) ack(senderid, connid, seqid uint32) {
+func (c *writeCache) close(senderid, connid uint32) {
 	key := packetKey(senderid, connid)
+	sh := c.shard(key)
 
-	c.RLock()
-	cn, exist := c.conns[key]
-	c.RUnlock()
+	sh.Lock()
+	cn, exist := sh.conns[key]
+	delete(sh.conns, key)
+	sh.Unlock()
 	if !exist {
 		return
 	}
 
 	cn.Lock()
-	// logrus.WithFields(logrus.Fields{
-	// 	"senderid": senderid,
-	// 	"connid":   connid,
-	// 	"seqid":    seqid,
-	// }).Debugln("clean cached packet")
-	for k := range cn.seqence {
-		if k <= seqid {
-			delete(cn.seqence, k)
-		} else {
-			// maybe performance effictive
-			break
+	freed := cn.size
+	cn.size = 0
+	cn.closed = true
+	cn.seqence.advance(^uint32(0), (*packet).release)
+	cn.Unlock()
+
+	// wake up add blocked by window too
+	c.free(freed)
+}
+
+// expired returns packets that are not acked in rto since they are sent,
+// up to rtoburst per connection from the oldest. Their sent is reset to now
+// so that they are not returned again before rto. It recovers the last
+// packets of a burst, which peer can't request as it doesn't know they're
+// missing. They are held for the caller.
+func (c *writeCache) expired(now int64) (ps []*packet) {
+	var conns []*connCache
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.RLock()
+		for _, cn := range sh.conns {
+			conns = append(conns, cn)
 		}
+		sh.RUnlock()
 	}
-	if seqid > cn.lastack {
-		cn.lastack = seqid
+
+	for _, cn := range conns {
+		cn.RLock()
+		var n int
+		for k := cn.seqence.base; k <= cn.top && n < rtoburst; k++ {
+			p := cn.seqence.get(k)
+			if p == nil {
+				continue
+			}
+			p.lock.Lock()
+			if p.sent < now-int64(rto) {
+				p.sent = now
+				p.hold()
+				ps = append(ps, p)
+				n++
+			}
+			p.lock.Unlock()
+		}
+		cn.RUnlock()
 	}
-	cn.Unlock()
+	return
 }
 
-func (c *writeCache) close(senderid, connid uint32) {
-	key := packetKey(senderid, connid)
-
-	c.Lock()
-	delete(c.conns, key)
-	c.Unlock()
+// usage returns bytes cached and number of connections
+func (c *writeCache) usage() (size int64, conns int) {
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.RLock()
+		conns += len(sh.conns)
+		sh.RUnlock()
+	}
+	return atomic.LoadInt64(&c.size), conns
 }
@@ -0,0 +1,153 @@
+package trafcacc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWriteCacheBudget(t *testing.T) {
+	c := newWriteCache()
+	buf := make([]byte, mtu)
+
+	// fill the cache of a connection up to its budget, window of peer is
+	// not the limit
+	c.add(&packet{Senderid: 1, Connid: 1, Seqid: 1, Buf: buf})
+	c.ack(1, 1, 0, 1<<20)
+	seqid := uint32(1)
+	for size := mtu; size < cacheconn; size += mtu {
+		seqid++
+		c.add(&packet{Senderid: 1, Connid: 1, Seqid: seqid, Buf: buf})
+	}
+
+	added := make(chan struct{})
+	go func() {
+		c.add(&packet{Senderid: 1, Connid: 1, Seqid: seqid + 1, Buf: buf})
+		added <- struct{}{}
+	}()
+	select {
+	case <-added:
+		t.Fatal("expect add blocked by connection budget")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// other connections are not blocked by it
+	c.add(&packet{Senderid: 1, Connid: 2, Seqid: 1, Buf: buf})
+
+	c.ack(1, 1, seqid/2, 1<<20)
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("expect add unblocked by ack")
+	}
+
+	size, conns := c.usage()
+	if want := int64(seqid-seqid/2+2) * mtu; size != want || conns != 2 {
+		t.Fatal("unexpected usage", size, want, conns)
+	}
+	c.close(1, 1)
+	c.close(1, 2)
+	if size, conns = c.usage(); size != 0 || conns != 0 {
+		t.Fatal("expect cache empty after close", size, conns)
+	}
+}
+
+func TestWriteCacheWindow(t *testing.T) {
+	c := newWriteCache()
+	buf := make([]byte, 10)
+	for seqid := uint32(1); seqid <= recvwindow; seqid++ {
+		c.add(&packet{Senderid: 1, Connid: 1, Seqid: seqid, Buf: buf})
+	}
+
+	added := make(chan struct{})
+	go func() {
+		c.add(&packet{Senderid: 1, Connid: 1, Seqid: recvwindow + 1, Buf: buf})
+		added <- struct{}{}
+	}()
+	select {
+	case <-added:
+		t.Fatal("expect add blocked by window")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// acked but window is not moved
+	c.ack(1, 1, recvwindow, recvwindow)
+	select {
+	case <-added:
+		t.Fatal("expect add blocked by window")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	c.ack(1, 1, recvwindow, recvwindow+1)
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("expect add unblocked by window")
+	}
+}
+
+func TestWriteCacheExpired(t *testing.T) {
+	c := newWriteCache()
+	for seqid := uint32(1); seqid <= rtoburst+2; seqid++ {
+		c.add(&packet{Senderid: 1, Connid: 1, Seqid: seqid, Buf: []byte{1}})
+	}
+	c.ack(1, 1, 1, recvwindow)
+
+	now := time.Now().UnixNano()
+	if ps := c.expired(now); len(ps) != 0 {
+		t.Fatal("expect nothing expired in rto", len(ps))
+	}
+	now += int64(rto) * 2
+	ps := c.expired(now)
+	if len(ps) != rtoburst || ps[0].Seqid != 2 {
+		t.Fatal("expect the oldest unacked packets expired", len(ps))
+	}
+	if ps = c.expired(now); len(ps) != 1 || ps[0].Seqid != rtoburst+2 {
+		t.Fatal("expect expired ones not returned again in rto", len(ps))
+	}
+}
+
+func TestAckdue(t *testing.T) {
+	pq := newPacketQueue()
+	pq.create(1, 1)
+	a := pq.add(&packet{Senderid: 1, Connid: 1, Seqid: 1})
+	if a == nil || a.Seqid != 1 || ackWindow(a) != recvwindow {
+		t.Fatal("expect the first packet acked with window", a)
+	}
+	// out of order, and in ackinterval
+	if pq.add(&packet{Senderid: 1, Connid: 1, Seqid: 3}) != nil ||
+		pq.add(&packet{Senderid: 1, Connid: 1, Seqid: 2}) != nil {
+		t.Fatal("expect no ack in ackinterval")
+	}
+	// beyond window
+	pq.add(&packet{Senderid: 1, Connid: 1, Seqid: recvwindow + 1})
+	q := pq.get(1, 1)
+	if q.len() != 3 {
+		t.Fatal("expect packet beyond window dropped", q.len())
+	}
+
+	now := time.Now()
+	if seqid, wnd := q.ackdue(now.Add(ackinterval)); seqid != 3 || wnd != recvwindow {
+		t.Fatal("expect packets in order acked", seqid, wnd)
+	}
+	if seqid, _ := q.ackdue(now.Add(ackinterval * 2)); seqid != 0 {
+		t.Fatal("expect no ack of nothing new", seqid)
+	}
+	if seqid, _ := q.ackdue(now.Add(ackinterval + ackrepeat)); seqid != 3 {
+		t.Fatal("expect the last ack repeated", seqid)
+	}
+	if seqid, _ := q.ackdue(now.Add(keepalive * 2)); seqid != 0 {
+		t.Fatal("expect no repeat of idle queue", seqid)
+	}
+
+	// window is advertised once read moves it by a quarter
+	for i := 0; i < 3; i++ {
+		pq.pop(1, 1)
+	}
+	if pq.ackdue(1, 1) != nil {
+		t.Fatal("expect no ack of small window move")
+	}
+	q.waitingSeqid += recvwindow / 4
+	if a := pq.ackdue(1, 1); a == nil || ackWindow(a) != q.window() {
+		t.Fatal("expect window advertised", a)
+	}
+}
@@ -0,0 +1,121 @@
+package trafcacc
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// congestion controller of udp upstream, tcp is left to the congestion
+// control of kernel. Sends are paced at rate, which is updated on every rtt
+// sample of probes by AIMD: it's cut by ccbeta when data loss since the last
+// delivery sample is above lossspike or rtt is queued ccdelay above the
+// minimum, otherwise it doubles in slow start or grows by ccstep if the
+// upstream is not app-limited.
+type congestion struct {
+	mux      sync.Mutex
+	rate     int64 // bytes per second
+	ssthresh int64
+
+	// the minimum rtt in ccminrttwindow, and when it's sampled
+	minrtt   int64
+	minrttat int64
+
+	// delivered, bytes sent and time at the last update
+	last   [2]uint64
+	sent   uint64
+	update int64
+
+	// when the next packet may be sent
+	next int64
+}
+
+func (c *congestion) current() int64 {
+	return atomic.LoadInt64(&c.rate)
+}
+
+// updaterate of u with rtt sample r at now
+func (c *congestion) updaterate(u *upstream, r, now int64) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.rate == 0 {
+		atomic.StoreInt64(&c.rate, ccinitrate)
+		c.ssthresh = ccmaxrate
+	}
+	if c.minrtt == 0 || r < c.minrtt || time.Duration(now-c.minrttat) > ccminrttwindow {
+		c.minrtt, c.minrttat = r, now
+	}
+
+	sent := atomic.LoadUint64(&u.sent)
+	elapsed := now - c.update
+	var used int64
+	if c.update != 0 && elapsed > 0 && sent >= c.sent {
+		used = int64(sent-c.sent) * int64(time.Second) / elapsed
+	}
+	c.sent, c.update = sent, now
+
+	var loss float64
+	if d, ok := u.delivered.Load().([2]uint64); ok && d != c.last {
+		last := c.last
+		c.last = d
+		if last[0] != 0 && d[0] > last[0] && d[1] >= last[1] {
+			if s, got := d[0]-last[0], d[1]-last[1]; got < s {
+				loss = float64(s-got) / float64(s)
+			}
+		}
+	}
+
+	rate := c.rate
+	switch {
+	case loss >= lossspike || r > c.minrtt+int64(ccdelay):
+		rate = rate * ccbeta / 100
+		if rate < ccminrate {
+			rate = ccminrate
+		}
+		c.ssthresh = rate
+	case used < rate/2:
+		// app-limited, rate is not probed
+	case rate < c.ssthresh:
+		rate *= 2
+	default:
+		rate += ccstep
+	}
+	if rate > ccmaxrate {
+		rate = ccmaxrate
+	}
+	atomic.StoreInt64(&c.rate, rate)
+}
+
+// delay returns how long the next data packet waits for its turn
+func (c *congestion) delay() time.Duration {
+	if c.current() <= 0 {
+		return 0
+	}
+	c.mux.Lock()
+	next := c.next
+	c.mux.Unlock()
+	return time.Duration(next - time.Now().UnixNano())
+}
+
+// pace n bytes to send at rate, it waits for its turn if wait is true.
+// Sends are allowed to burst up to ccburst after idle.
+func (c *congestion) pace(n int, wait bool) {
+	rate := c.current()
+	if rate <= 0 {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	c.mux.Lock()
+	if c.next < now-int64(ccburst) {
+		c.next = now - int64(ccburst)
+	}
+	next := c.next
+	c.next += int64(n) * int64(time.Second) / rate
+	c.mux.Unlock()
+
+	if d := time.Duration(next - now); wait && d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,75 @@
+package trafcacc
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCongestion(t *testing.T) {
+	u := testUpstream(udp, 1)
+	c := &u.cc
+	rtt := int64(time.Millisecond * 10)
+	now := time.Now().UnixNano()
+
+	// step sends bytes at used rate of c, and delivers all but loss of them
+	var recv uint64
+	step := func(used int64, loss float64, r int64) int64 {
+		now += int64(time.Second)
+		n := uint64(used)
+		atomic.AddUint64(&u.sent, n)
+		recv += n - uint64(float64(n)*loss)
+		u.delivered.Store([2]uint64{atomic.LoadUint64(&u.sent), recv})
+		c.updaterate(u, r, now)
+		return c.current()
+	}
+
+	step(0, 0, rtt)
+	if c.current() != ccinitrate {
+		t.Fatal("expect initial rate", c.current())
+	}
+	if rate := step(ccinitrate/4, 0, rtt); rate != ccinitrate {
+		t.Fatal("expect app-limited rate kept", rate)
+	}
+	if rate := step(ccinitrate, 0, rtt); rate != ccinitrate*2 {
+		t.Fatal("expect rate doubled in slow start", rate)
+	}
+	if rate := step(ccinitrate*2, lossspike*2, rtt); rate != ccinitrate*2*ccbeta/100 {
+		t.Fatal("expect rate cut on loss", rate)
+	}
+	cut := c.current()
+	if rate := step(cut, 0, rtt); rate != cut+ccstep {
+		t.Fatal("expect rate grows additively after cut", rate)
+	}
+	if rate := step(cut+ccstep, 0, rtt+int64(ccdelay)*2); rate != (cut+ccstep)*ccbeta/100 {
+		t.Fatal("expect rate cut on queueing delay", rate)
+	}
+	for i := 0; i < 100; i++ {
+		step(c.current(), 1, rtt)
+	}
+	if c.current() != ccminrate {
+		t.Fatal("expect rate kept at minimum", c.current())
+	}
+}
+
+func TestPace(t *testing.T) {
+	c := &congestion{rate: 1024 * 1024}
+
+	// a burst is allowed after idle, then sends are spaced at rate
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		c.pace(1024, true)
+	}
+	// the last one waits for 9KB at 1MB/s, less the burst
+	if d := time.Since(start); d < time.Millisecond*9-ccburst-time.Millisecond || d > time.Millisecond*100 {
+		t.Fatal("expect 10KB sent in about 9ms at 1MB/s", d)
+	}
+
+	// control packets are not delayed
+	c.next = time.Now().UnixNano() + int64(time.Second)
+	start = time.Now()
+	c.pace(64, false)
+	if d := time.Since(start); d > time.Millisecond {
+		t.Fatal("expect control packet sent at once", d)
+	}
+}
@@ -12,6 +12,9 @@ import (
 // packet conn
 type pconn interface {
 	streampool() *streampool
+	pools() []*streampool
+	SetScheduler(Scheduler)
+	SetKey([]byte)
 	pq() *packetQueue
 	write(*packet)
 	role() string
@@ -28,8 +31,7 @@ type packetconn struct {
 	rdr bytes.Buffer
 
 	// Write
-	werr     atomic.Value
-	parallel int32
+	werr atomic.Value
 }
 
 func newConn(c pconn, senderid, connid uint32) *packetconn {
@@ -59,6 +61,7 @@ func (c *packetconn) Read(b []byte) (n int, err error) {
 		}
 		// buffered reader writer
 		_, err := c.rdr.Write(p.Buf)
+		p.release()
 		if err != nil {
 			// TODO: deal with ErrTooLarge
 		}
@@ -68,6 +71,11 @@ func (c *packetconn) Read(b []byte) (n int, err error) {
 		}
 	}
 
+	// window is moved by what is read
+	if a := c.pq().ackdue(c.senderid, c.connid); a != nil {
+		c.write(a)
+	}
+
 	if c.pq().isClosed(c.senderid, c.connid) && c.rdr.Len() <= 0 {
 		return 0, io.EOF
 	}
@@ -78,38 +86,30 @@ func (c *packetconn) Read(b []byte) (n int, err error) {
 // Write writes data to the connection.
 // Write can be made to time out and return a Error with Timeout() == true
 // after a fixed time limit; see SetDeadline and SetWriteDeadline.
-func (c *packetconn) Write(b0 []byte) (n int, err error) {
+func (c *packetconn) Write(b []byte) (n int, err error) {
 	// You can not send messages (datagrams) larger than 2^16 65536 octets with UDP.
 	if c.werr.Load() != nil {
 		return 0, c.werr.Load().(error)
 	}
 
-	n = len(b0)
-	b := make([]byte, n)
-	copy(b, b0)
-
+	n = len(b)
 	for m := 0; m < n; m += mtu {
 		sz := n - m
 		if sz > mtu {
 			sz = mtu
 		}
-		p := &packet{
-			Senderid: c.senderid,
-			Seqid:    atomic.AddUint32(&c.seqid, 1),
-			Connid:   c.connid,
-			Buf:      b[m : m+sz],
-			Time:     time.Now().UnixNano(),
-		}
-		if atomic.LoadInt32(&c.parallel) > 300 {
-			c.write(p)
-		} else {
-			go func() {
-				atomic.AddInt32(&c.parallel, 1)
-				defer atomic.AddInt32(&c.parallel, -1)
-				c.write(p)
-			}()
-		}
-
+		p := newPooledPacket()
+		p.Senderid = c.senderid
+		p.Seqid = atomic.AddUint32(&c.seqid, 1)
+		p.Connid = c.connid
+		p.Buf = p.Buf[:sz]
+		copy(p.Buf, b[m:])
+		p.Time = time.Now().UnixNano()
+		// cached before sent, it blocks while the cache is full or window
+		// of peer is closed
+		c.streampool().cache.add(p)
+		c.write(p)
+		p.release()
 	}
 
 	return n, nil
@@ -1,11 +1,12 @@
 package trafcacc
 
 import (
-	"encoding/gob"
+	"context"
 	"errors"
 	"math/rand"
 	"net"
-	"strconv"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -19,29 +20,201 @@ type dialer struct {
 	atomicid uint32
 
 	udpbuf []byte
+
+	// upstreams by proto://host:port?options, guarded by upmux
+	upmux     sync.Mutex
+	upstreams map[string]*upstream
+	groups    map[string]int
+	endpoints []Endpoint
+
+	// number of upstreams failed to connect, and the last error message
+	down    int32
+	downerr atomic.Value
+
+	// lookup resolves hostname of endpoints, lookupHost but in tests
+	lookup func(host string) ([]string, error)
 }
 
 func newDialer() *dialer {
-	return &dialer{
-		identity: rand.Uint32(),
-		node:     newNode("dialer"),
+	d := &dialer{
+		identity:  rand.Uint32(),
+		node:      newNode("dialer"),
+		upstreams: make(map[string]*upstream),
+		groups:    make(map[string]int),
+		lookup:    lookupHost,
 	}
+	go d.resolveloop()
+	go d.downloop()
+	return d
 }
 
 // Setup upstream servers
-func (d *dialer) Setup(server string) {
-	for _, e := range parse(server) {
-		grp := 0
-		for p := e.portBegin; p <= e.portEnd; p++ {
-			u := newUpstream(e.proto)
-			u.addr = net.JoinHostPort(e.host, strconv.Itoa(p))
-			d.pool.append(u, grp)
-			go d.connect(u)
+func (d *dialer) Setup(server string) error {
+	return d.Reload(server)
+}
+
+// Reload upstream servers. Upstreams that are new to server get connected,
+// the ones no longer listed are drained and closed. Established connections
+// are kept.
+func (d *dialer) Reload(server string) error {
+	endpoints, err := ParseEndpoints(server)
+	if err != nil {
+		return err
+	}
+
+	d.upmux.Lock()
+	d.endpoints = endpoints
+	d.upmux.Unlock()
+
+	d.resolve()
+	return nil
+}
+
+// resolveloop re-resolve upstream hostnames every resolvettl
+func (d *dialer) resolveloop() {
+	tick := time.NewTicker(resolvettl)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			d.resolve()
+		case <-d.ctx.Done():
+			return
+		}
+	}
+}
+
+// Close stops d, upstreams are closed at once without draining
+func (d *dialer) Close() error {
+	d.stop()
+
+	d.upmux.Lock()
+	defer d.upmux.Unlock()
+	d.endpoints = nil
+	for key, u := range d.upstreams {
+		delete(d.upstreams, key)
+		atomic.StoreInt32(&u.retired, 1)
+		d.pool.remove(u)
+		u.close()
+	}
+	return nil
+}
+
+// resolve hostnames of endpoints into upstreams, one upstream per address
+// and port. Upstreams that are new get connected, the ones whose address is
+// no longer listed or resolved are drained and closed.
+func (d *dialer) resolve() {
+	d.upmux.Lock()
+	endpoints := d.endpoints
+	d.upmux.Unlock()
+
+	// lookup without holding the lock
+	hosts := make([][]string, len(endpoints))
+	errs := make([]error, len(endpoints))
+	for i, e := range endpoints {
+		hosts[i], errs[i] = d.lookup(e.Host)
+	}
+
+	d.upmux.Lock()
+	defer d.upmux.Unlock()
+	// closed while looking up
+	if d.ctx.Err() != nil {
+		return
+	}
+
+	listed := make(map[string]bool)
+	for i, e := range endpoints {
+		origin := e.key(e.Host)
+		if errs[i] != nil {
+			logrus.WithFields(logrus.Fields{
+				"host":  e.Host,
+				"error": errs[i],
+			}).Warnln("dialer resolve upstream host error")
+			if d.keep(origin, listed) {
+				continue
+			}
+			// nothing resolved yet, let net.Dial resolve the name
+			hosts[i] = []string{e.Host}
+		}
+
+		grp := d.groupid(e.groupname())
+		for _, h := range hosts[i] {
+			re := e
+			re.Host = h
+			for _, addr := range re.Addrs() {
+				key := re.key(addr)
+				listed[key] = true
+				if _, exist := d.upstreams[key]; exist {
+					continue
+				}
+				u := newUpstream(e.Proto)
+				u.addr = addr
+				u.bind = e.Bind
+				u.weight = e.Weight
+				u.origin = origin
+				u.token = rand.Uint64() | 1
+				d.upstreams[key] = u
+				d.pool.append(u, grp)
+				go d.connect(u)
+			}
+		}
+	}
+
+	for key, u := range d.upstreams {
+		if !listed[key] {
+			delete(d.upstreams, key)
+			logrus.WithField("upstream", key).Infoln("dialer drain upstream")
+			go d.pool.drain(u)
 		}
-		grp++
 	}
 }
 
+// keep upstreams resolved from origin listed, returns false if there is none
+func (d *dialer) keep(origin string, listed map[string]bool) (kept bool) {
+	for key, u := range d.upstreams {
+		if u.origin == origin {
+			listed[key] = true
+			kept = true
+		}
+	}
+	return
+}
+
+// lookupHost returns the A and AAAA addresses of host in stable order,
+// empty host and ip address are returned as is
+func lookupHost(host string) ([]string, error) {
+	if len(host) == 0 || net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), resolvetimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no address for " + host)
+	}
+
+	hosts := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		hosts = append(hosts, a.String())
+	}
+	sort.Strings(hosts)
+	return hosts, nil
+}
+
+// groupid returns the id of group name, allocate one if it's new
+func (d *dialer) groupid(name string) int {
+	id, exist := d.groups[name]
+	if !exist {
+		id = len(d.groups) + 1
+		d.groups[name] = id
+	}
+	return id
+}
+
 // Dial acts like net.Dial
 func (d *dialer) Dial() (net.Conn, error) {
 	return d.DialTimeout(time.Duration(0))
@@ -88,88 +261,194 @@ func (d *dialer) DialTimeout(timeout time.Duration) (net.Conn, error) {
 
 // connect to upstream server and keep tunnel alive
 func (d *dialer) connect(u *upstream) {
-	for {
-		conn, err := net.Dial(u.proto, u.addr)
+	var backoff time.Duration
+	for !u.isRetired() {
+		conn, err := u.dial()
 		if err != nil {
+			d.setdown(u, err)
+			backoff = nextBackoff(backoff)
 			logrus.WithFields(logrus.Fields{
-				"addr":  u.addr,
-				"error": err,
-			}).Warnln("Dialer dial upstream error")
-			time.Sleep(time.Second)
+				"addr":    u.addr,
+				"error":   err,
+				"backoff": backoff,
+			}).Debugln("Dialer dial upstream error")
+			time.Sleep(jitter(backoff))
 			continue
 		}
 
-		u.conn = conn
-
-		switch u.proto {
-		case tcp:
-			u.encoder = gob.NewEncoder(conn)
-			u.decoder = gob.NewDecoder(conn)
-		case udp:
+		if !u.start(conn) {
+			conn.Close()
+			return
 		}
 
-		atomic.StoreInt32(&u.closed, 0)
-
 		// begin to ping
-		go d.pingloop(u)
+		go d.pingloop(u.ctx, u)
 
 		atomic.StoreInt64(&u.alive, time.Now().UnixNano())
+		d.unsetdown(u)
 
+		connected := time.Now()
 		d.readloop(u)
 
 		u.close()
+
+		// retry at once only if the connection had been stable
+		if time.Since(connected) >= stableconn {
+			backoff = 0
+		} else {
+			d.setdown(u, errors.New("upstream connection lost"))
+			backoff = nextBackoff(backoff)
+			time.Sleep(jitter(backoff))
+		}
 	}
+	d.unsetdown(u)
+}
+
+func (d *dialer) setdown(u *upstream, err error) {
+	if atomic.CompareAndSwapInt32(&u.down, 0, 1) {
+		atomic.AddInt32(&d.down, 1)
+	}
+	d.downerr.Store(err.Error())
+}
+
+func (d *dialer) unsetdown(u *upstream) {
+	if atomic.CompareAndSwapInt32(&u.down, 1, 0) {
+		atomic.AddInt32(&d.down, -1)
+	}
+}
+
+// downloop summarize upstreams that failed to connect in one log line
+func (d *dialer) downloop() {
+	var last int32
+	tick := time.NewTicker(downlogperiod)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-d.ctx.Done():
+			return
+		}
+		down := atomic.LoadInt32(&d.down)
+		if down == 0 && last == 0 {
+			continue
+		}
+		last = down
+
+		d.upmux.Lock()
+		total := len(d.upstreams)
+		d.upmux.Unlock()
+
+		fields := logrus.Fields{
+			"down":  down,
+			"total": total,
+		}
+		if err, ok := d.downerr.Load().(string); ok && down > 0 {
+			fields["error"] = err
+		}
+		logrus.WithFields(fields).Warnln(down, "upstreams down")
+	}
+}
+
+// nextBackoff doubles backoff, starts from backoffmin and caps at backoffmax
+func nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff < backoffmin {
+		backoff = backoffmin
+	}
+	if backoff > backoffmax {
+		backoff = backoffmax
+	}
+	return backoff
+}
+
+// jitter returns a random duration in [d/2, d)
+func jitter(d time.Duration) time.Duration {
+	half := int64(d / 2)
+	if half <= 0 {
+		return d
+	}
+	return time.Duration(half + rand.Int63n(half))
 }
 
 func (d *dialer) readloop(u *upstream) {
+	if u.proto == udp {
+		d.readudp(u)
+		return
+	}
 	for {
 		if atomic.LoadInt32(&u.closed) != 0 {
-			logrus.WithField("proto", u.proto).Warnln("dialer upstream is closed")
+			logrus.WithField("proto", u.proto).Debugln("dialer upstream is closed")
 			return
 		}
-		p := packet{}
-		switch u.proto {
-		case tcp:
-			err := u.decoder.Decode(&p)
-			if err != nil {
-				logrus.WithFields(logrus.Fields{
-					"error": err,
-				}).Warnln("Dialer docode upstream packet")
-				return
-			}
-		case udp:
-			udpbuf := make([]byte, buffersize)
-			n, err := u.conn.Read(udpbuf)
-			if err != nil {
-				logrus.WithError(err).Warnln("dialer Read UDP error")
-				return
-			}
-			if err := decodePacket(udpbuf[:n], &p); err != nil {
+		p := &packet{}
+		err := u.decoder.Decode(p)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Debugln("Dialer docode upstream packet")
+			return
+		}
+
+		d.proc(u, p)
+	}
+}
+
+// readudp reads packets of udp upstream u in batches
+func (d *dialer) readudp(u *upstream) {
+	r := newBatchReader(u.batch)
+	defer r.close()
+	for {
+		if atomic.LoadInt32(&u.closed) != 0 {
+			logrus.WithField("proto", u.proto).Debugln("dialer upstream is closed")
+			return
+		}
+		err := r.read(func(p *packet, _ *net.UDPAddr) {
+			if err := decodePacket(p.Buf, p); err != nil {
+				p.release()
 				logrus.WithError(err).Warnln("dialer gop decode from udp error")
-				continue
+				return
 			}
 			p.udp = true
+			d.proc(u, p)
+		})
+		if err != nil {
+			logrus.WithError(err).Debugln("dialer Read UDP error")
+			return
 		}
-
-		d.proc(u, &p)
 	}
 }
 
+// proc p received from u, data is handed over to push and the rest is
+// released
 func (d *dialer) proc(u *upstream, p *packet) {
 	d.node.proc(u, p)
 	if p.Cmd == data {
 		go d.push(p)
+	} else {
+		p.release()
 	}
 }
 
-func (d *dialer) pingloop(u *upstream) {
-	ch := time.Tick(time.Second)
+// pingloop send ping every pinginterval until ctx of the conn is done, a
+// ping is missed if there is no pong before the next one
+func (d *dialer) pingloop(ctx context.Context, u *upstream) {
+	tick := time.NewTicker(pinginterval)
+	defer tick.Stop()
+	atomic.StoreInt32(&u.ponged, 0)
 	for {
-		err := u.send(ping)
-		if err != nil {
-			u.close()
-			break
+		// u is closed
+		if u.sendprobe(ping, d.identity, d.pool.probeflags(), d.signkey()) != nil {
+			return
 		}
-		<-ch
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+		// closed while waiting
+		if ctx.Err() != nil {
+			return
+		}
+		u.probed(atomic.SwapInt32(&u.ponged, 0) != 0)
 	}
 }
@@ -0,0 +1,137 @@
+package trafcacc
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestResolve(t *testing.T) {
+	errLookup := errors.New("lookup error")
+	steps := []struct {
+		hosts map[string][]string // nil is lookup error
+		addrs []string
+	}{
+		// every address resolved gets an upstream
+		{map[string][]string{"a": {"127.0.0.1", "127.0.0.2"}},
+			[]string{"127.0.0.1:55050", "127.0.0.2:55050"}},
+		// failed lookup keeps what is resolved before
+		{map[string][]string{},
+			[]string{"127.0.0.1:55050", "127.0.0.2:55050"}},
+		// address no longer returned is drained
+		{map[string][]string{"a": {"127.0.0.2"}},
+			[]string{"127.0.0.2:55050"}},
+		{map[string][]string{"a": {"127.0.0.2", "127.0.0.3"}},
+			[]string{"127.0.0.2:55050", "127.0.0.3:55050"}},
+	}
+
+	d := newDialer()
+	defer d.Close()
+	var step int
+	d.lookup = func(host string) ([]string, error) {
+		if hosts, ok := steps[step].hosts[host]; ok {
+			return hosts, nil
+		}
+		return nil, errLookup
+	}
+
+	upstreams := func() (addrs []string) {
+		d.upmux.Lock()
+		defer d.upmux.Unlock()
+		for _, u := range d.upstreams {
+			addrs = append(addrs, u.addr)
+		}
+		sort.Strings(addrs)
+		return
+	}
+
+	for i := range steps {
+		step = i
+		if i == 0 {
+			if err := d.Setup("tcp://a:55050"); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			d.resolve()
+		}
+		if addrs := upstreams(); !reflect.DeepEqual(addrs, steps[i].addrs) {
+			t.Fatal("unexpected upstreams at step", i, addrs)
+		}
+	}
+
+	// host never resolved is left to net.Dial
+	if err := d.Reload("tcp://b:55050"); err != nil {
+		t.Fatal(err)
+	}
+	if addrs := upstreams(); !reflect.DeepEqual(addrs, []string{"b:55050"}) {
+		t.Fatal("expect upstream of hostname", addrs)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for _, c := range []struct {
+		backoff, next time.Duration
+	}{
+		{0, backoffmin},
+		{backoffmin / 4, backoffmin},
+		{backoffmin, backoffmin * 2},
+		{time.Second * 5, time.Second * 10},
+		{backoffmax / 2, backoffmax},
+		{backoffmax * 3 / 4, backoffmax},
+		{backoffmax, backoffmax},
+	} {
+		if next := nextBackoff(c.backoff); next != c.next {
+			t.Fatal("unexpected backoff after", c.backoff, next)
+		}
+	}
+
+	for _, d := range []time.Duration{backoffmin, time.Second * 3, backoffmax} {
+		for i := 0; i < 100; i++ {
+			if j := jitter(d); j < d/2 || j >= d {
+				t.Fatal("expect jitter in [d/2, d)", d, j)
+			}
+		}
+	}
+	if j := jitter(1); j != 1 {
+		t.Fatal("expect tiny duration kept", j)
+	}
+}
+
+func TestPingloopStops(t *testing.T) {
+	l, err := net.ListenUDP(udp, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	d := newDialer()
+	defer d.Close()
+	u := newUpstream(udp)
+	defer u.close()
+
+	done := make(chan struct{}, 1)
+	for i := 0; i < 2; i++ {
+		conn, err := net.DialUDP(udp, nil, l.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the loop of the last conn quits once it's closed
+		u.close()
+		if i > 0 {
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("expect pingloop of the closed conn quit")
+			}
+		}
+		u.start(conn)
+		ctx := u.ctx
+		go func() {
+			d.pingloop(ctx, u)
+			done <- struct{}{}
+		}()
+	}
+}
@@ -1,6 +1,7 @@
 package trafcacc
 
 import (
+	"errors"
 	"net"
 	"runtime"
 	"strconv"
@@ -24,37 +25,73 @@ func (t *trafcacc) Status() {
 		"HeapObjects":  s.HeapObjects,
 	}
 
+	// backend has a pool per frontend peer
+	pools := t.pconn.pools()
+	var copies, udpmode string
+	for _, pool := range pools {
+		var prefix string
+		if t.role == BACKEND {
+			if pool.peer == 0 {
+				// upstreams of unknown peer
+				continue
+			}
+			prefix = strconv.FormatUint(uint64(pool.peer), 16) + ":"
+		}
+		pool.RLock()
+		copies += prefix + strconv.Itoa(pool.copies) + " (" + pool.copiesreason + "),"
+		pool.RUnlock()
+		udpmode += prefix + pool.udpmode() + ","
+	}
+	size, conns := t.pconn.streampool().cache.usage()
+	fields["CACHE"] = humanbyte(uint64(size)) + "/" + humanbyte(cacheall) +
+		" (" + strconv.Itoa(conns) + " conns)"
+	fields["COPIES"] = strings.TrimRight(copies, ",")
+	fields["UDP"] = strings.TrimRight(udpmode, ",")
+
 	if logrus.GetLevel() >= logrus.DebugLevel {
-		t.pool.RLock()
 		// var us, ts, ur, tr string
-		var su, st, ru, rt uint64
+		var su, st, ru, rt, dropped, rate uint64
 		var total, alived int
-		var latency string
-		for _, v := range t.pool.pool {
-			total++
-			if v.isAlive() {
-				alived++
-			}
-			s := atomic.LoadUint64(&v.sent)
-			r := atomic.LoadUint64(&v.recv)
-			if v.proto == udp {
-				su += s
-				ru += r
-				// us += humanbyte(s) + ","
-				// ur += humanbyte(r) + ","
-			} else {
-				st += s
-				rt += r
-				// ts += humanbyte(s) + ","
-				// tr += humanbyte(r) + ","
-			}
-			lc := int(atomic.LoadInt64(&v.latency) / int64(time.Millisecond))
-			if lc > 100 {
-				latency += strconv.Itoa(lc) + ","
+		var latency, loss, breakers string
+		for _, pool := range pools {
+			pool.RLock()
+			for _, v := range pool.pool {
+				total++
+				if v.isAlive() {
+					alived++
+				}
+				s := atomic.LoadUint64(&v.sent)
+				r := atomic.LoadUint64(&v.recv)
+				if v.proto == udp {
+					su += s
+					ru += r
+					rate += uint64(v.cc.current())
+					// us += humanbyte(s) + ","
+					// ur += humanbyte(r) + ","
+				} else {
+					st += s
+					rt += r
+					// ts += humanbyte(s) + ","
+					// tr += humanbyte(r) + ","
+				}
+				dropped += atomic.LoadUint64(&v.sendq.dropped)
+				lc := int(atomic.LoadInt64(&v.srtt) / int64(time.Millisecond))
+				if lc > 100 {
+					latency += strconv.Itoa(lc) + ","
+				}
+				if v.brk.current() != breakerClosed {
+					breakers += v.proto + strconv.FormatUint(v.uuid, 10) + ":" + v.brk.String() + ","
+				}
+				if in, out := v.LossIn(), v.LossOut(); in >= lossclean || out >= lossclean {
+					loss += v.proto + strconv.FormatUint(v.uuid, 10) + ":" +
+						strconv.FormatFloat(in*100, 'f', 1, 64) + "/" +
+						strconv.FormatFloat(out*100, 'f', 1, 64) + "%,"
+				}
 			}
+			pool.RUnlock()
 		}
-		t.pool.RUnlock()
 		fields["Sent(U)"] = humanbyte(su) // + "(" + strings.TrimRight(us, ",") + ")"
+		fields["RATE(U)"] = humanbyte(rate) + "/s"
 		fields["Recv(U)"] = humanbyte(ru) // + "(" + strings.TrimRight(ur, ",") + ")"
 
 		fields["Sent(T)"] = humanbyte(st) // + "(" + strings.TrimRight(ts, ",") + ")"
@@ -64,7 +101,10 @@ func (t *trafcacc) Status() {
 		fields["POP(U)"] = humanbyte(atomic.LoadUint64(&t.pconn.pq().popudp))
 
 		fields["PQLEN"] = t.pconn.pq().len()
+		fields["DROP(Q)"] = dropped
 		fields["LATENCY"] = latency
+		fields["LOSS(IN/OUT)"] = strings.TrimRight(loss, ",")
+		fields["BREAKER"] = strings.TrimRight(breakers, ",")
 		fields["ALIVE"] = strconv.Itoa(alived) + "/" + strconv.Itoa(total)
 	}
 
@@ -102,7 +142,10 @@ func acceptTCP(ln net.Listener, f func(net.Conn)) {
 				time.Sleep(tempDelay)
 				continue
 			}
-			logrus.Fatalln(err)
+			if !errors.Is(err, net.ErrClosed) {
+				logrus.WithError(err).Errorln("accept error")
+			}
+			return
 		}
 		tempDelay = 0
 
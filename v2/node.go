@@ -1,6 +1,7 @@
 package trafcacc
 
 import (
+	"context"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -12,17 +13,28 @@ type node struct {
 	pool    *streampool
 	pqs     *packetQueue
 	name    string
-	lastack int64
 	lastrqu int64
-	mux     sync.Mutex
+
+	// pools of upstreams by peer identity, server only. pool holds the
+	// upstreams whose peer is not known yet.
+	pmux  sync.RWMutex
+	peers map[uint32]*streampool
+
+	// key shared by peers to sign pings, []byte, see SetKey
+	key atomic.Value
+
+	// loops of n, its pools and its owner quit once ctx is done, see stop
+	ctx  context.Context
+	stop context.CancelFunc
 }
 
 func newNode(name string) *node {
 	n := &node{
 		pqs:  newPacketQueue(),
-		pool: newStreamPool(),
 		name: name,
 	}
+	n.ctx, n.stop = context.WithCancel(context.Background())
+	n.pool = newStreamPool(n.ctx)
 	go n.rquloop()
 	return n
 }
@@ -39,30 +51,130 @@ func (n *node) role() string {
 	return n.name
 }
 
+// SetScheduler set the policy of picking upstreams for packets
+func (n *node) SetScheduler(s Scheduler) {
+	n.pmux.Lock()
+	defer n.pmux.Unlock()
+	n.pool.setScheduler(s)
+	for _, pool := range n.peers {
+		pool.setScheduler(s)
+	}
+}
+
+// SetKey set the key shared by frontend and backend to sign pings, backend
+// follows the address change of a udp upstream only if its pings are signed
+func (n *node) SetKey(key []byte) {
+	n.key.Store(append([]byte(nil), key...))
+}
+
+func (n *node) signkey() []byte {
+	key, _ := n.key.Load().([]byte)
+	return key
+}
+
+// poolof returns the pool of upstreams to peer, nil if there is none.
+// Dialer has only one pool.
+func (n *node) poolof(peer uint32) *streampool {
+	if n.peers == nil || peer == 0 {
+		return n.pool
+	}
+
+	n.pmux.RLock()
+	defer n.pmux.RUnlock()
+	return n.peers[peer]
+}
+
+// join u to the pool of peer from the pool of upstreams whose peer is
+// unknown, the pool is created if there is none. u closed is not joined, as
+// it may have left already.
+func (n *node) join(u *upstream, peer uint32) {
+	n.pmux.Lock()
+	defer n.pmux.Unlock()
+	if atomic.LoadInt32(&u.closed) != 0 {
+		return
+	}
+	n.pool.remove(u)
+	atomic.StoreUint32(&u.peer, peer)
+	pool, exist := n.peers[peer]
+	if !exist {
+		pool = newStreamPool(n.ctx)
+		pool.peer = peer
+		// packets are cached and acked regardless of the upstreams
+		pool.cache = n.pool.cache
+		n.pool.RLock()
+		pool.scheduler = n.pool.scheduler
+		n.pool.RUnlock()
+		n.peers[peer] = pool
+	}
+	pool.append(u, u.grp)
+}
+
+// leave removes u closed from the pool it's in, the pool of a peer is
+// removed and stopped with its last upstream, so that peers gone don't pile
+// up
+func (n *node) leave(u *upstream) {
+	n.pmux.Lock()
+	defer n.pmux.Unlock()
+	peer := atomic.LoadUint32(&u.peer)
+	if peer == 0 {
+		n.pool.remove(u)
+		return
+	}
+	pool, exist := n.peers[peer]
+	if !exist {
+		return
+	}
+	pool.remove(u)
+	pool.RLock()
+	empty := len(pool.pool) == 0
+	pool.RUnlock()
+	if empty {
+		delete(n.peers, peer)
+		pool.stop()
+	}
+}
+
+// pools returns all the pools of n
+func (n *node) pools() []*streampool {
+	n.pmux.RLock()
+	defer n.pmux.RUnlock()
+	pools := []*streampool{n.pool}
+	for _, pool := range n.peers {
+		pools = append(pools, pool)
+	}
+	return pools
+}
+
+// write p on upstreams to the peer it's sent to
 func (n *node) write(p *packet) {
-	n.pool.write(p)
+	pool := n.poolof(p.Senderid)
+	if pool == nil {
+		// recovered by retransmit once the peer pings
+		logrus.WithField("peer", p.Senderid).Debugln("no upstream to peer")
+		return
+	}
+	pool.write(p)
 }
 
-func (n *node) proc(u *upstream, p *packet) {
+// proc packet received from u, returns the probe if it's ping or pong
+func (n *node) proc(u *upstream, p *packet) (pb *probe) {
 
 	atomic.AddUint64(&u.recv, uint64(len(p.Buf)))
 
 	now := time.Now().UnixNano()
-	if p.Time != 0 {
-		jitter := now - p.Time
-		jj := atomic.LoadInt64(&u.jitter)
-		if jj > jitter {
-			atomic.StoreInt64(&u.jitter, jitter)
-		} else {
-			atomic.StoreInt64(&u.latency, jitter-jj)
-		}
-	}
-
 	switch p.Cmd {
 	case ping, pong:
 		atomic.StoreInt64(&u.alive, now)
+		if p.Cmd == pong {
+			atomic.StoreInt32(&u.ponged, 1)
+		}
+		pb = &probe{}
+		if decodeProbe(p.Buf, pb) != nil {
+			return nil
+		}
+		u.updateprobe(pb, now)
 	case ack:
-		n.pool.cache.ack(p.Senderid, p.Connid, p.Seqid)
+		n.pool.cache.ack(p.Senderid, p.Connid, p.Seqid, ackWindow(p))
 	case rqu:
 		rp := n.pool.cache.get(p.Senderid, p.Connid, p.Seqid)
 		if rp != nil {
@@ -81,6 +193,7 @@ func (n *node) proc(u *upstream, p *packet) {
 			} else {
 				rp.lock.Unlock()
 			}
+			rp.release()
 		} else {
 			logrus.WithFields(logrus.Fields{
 				"Senderid": p.Senderid,
@@ -100,21 +213,8 @@ func (n *node) push(p *packet) {
 		n.pqs.add(p)
 		n.pool.cache.close(p.Senderid, p.Connid)
 	case data: //data
-		if n.pqs.add(p) >= p.Seqid {
-			n.mux.Lock()
-			now := time.Now().UnixNano()
-			if now > n.lastack {
-				n.write(&packet{
-					Senderid: p.Senderid,
-					Connid:   p.Connid,
-					Seqid:    p.Seqid,
-					Cmd:      ack,
-					udp:      true,
-					Time:     now,
-				})
-				n.lastack = now + int64(time.Second)
-			}
-			n.mux.Unlock()
+		if a := n.pqs.add(p); a != nil {
+			n.write(a)
 		}
 	default:
 		logrus.WithFields(logrus.Fields{
@@ -124,14 +224,28 @@ func (n *node) push(p *packet) {
 }
 
 func (n *node) rquloop() {
+	tick := time.NewTicker(rqudelay)
+	defer tick.Stop()
 	for {
-		time.Sleep(rqudelay)
+		select {
+		case <-tick.C:
+		case <-n.ctx.Done():
+			return
+		}
 		now := time.Now()
-		n.pqs.mux.RLock()
-		for k, v := range n.pqs.queues {
+		for _, p := range n.pool.cache.expired(now.UnixNano()) {
+			go func(p *packet) {
+				n.write(p)
+				p.release()
+			}(p)
+		}
+		n.pqs.each(func(k uint64, v *queue) {
 			v.L.Lock()
-			_, exist := v.queue[v.waitingSeqid]
-			if v.maxseqid > v.waitingSeqid && !exist && v.waitTime.Before(now.Add(-rqudelay)) {
+			if seqid, wnd := v.ackdue(now); seqid != 0 {
+				senderid, connid := unpacketKey(k)
+				go n.write(newAck(senderid, connid, seqid, wnd))
+			}
+			if v.maxseqid > v.waitingSeqid && v.queue.get(v.waitingSeqid) == nil && v.waitTime.Before(now.Add(-rqudelay)) {
 				senderid, connid := unpacketKey(k)
 				waiting := v.waitingSeqid
 				v.waitTime = now.Add(rqudelay)
@@ -153,7 +267,6 @@ func (n *node) rquloop() {
 				}()
 			}
 			v.L.Unlock()
-		}
-		n.pqs.mux.RUnlock()
+		})
 	}
 }
@@ -1,6 +1,8 @@
 package trafcacc
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"sync"
@@ -33,6 +35,65 @@ type packet struct {
 	udp      bool
 	Time     int64
 	lock     sync.RWMutex
+	sentby   []*upstream // upstreams it's sent on, the latest last
+	sent     int64       // when it's cached to send, for retransmit
+
+	// pooled buffer Buf is sliced from, and holders of it, see bufpool
+	buf  *[]byte
+	refs int32
+}
+
+// bufpool keeps buffers of buffersize, so that steady transfer doesn't
+// allocate one per packet. Buf of a packet made by newPooledPacket is
+// sliced from a pooled buffer, which is put back when the last holder of the
+// packet releases it, Buf must not be used by anyone else after that.
+//
+// The maker of the packet is its first holder. Then:
+//   - reader of udp releases the packet after proc, unless it's data handed
+//     over to push
+//   - packetQueue holds data added and releases it if it's dropped, pop
+//     hands it over to Read of conn which releases it once copied
+//   - writeCache holds data until it's acked or the connection is closed,
+//     get and expired hold what they return for the caller
+//   - sendq holds a packet until it's written
+var bufpool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, buffersize)
+		return &b
+	},
+}
+
+func getbuf() *[]byte {
+	return bufpool.Get().(*[]byte)
+}
+
+func putbuf(b *[]byte) {
+	bufpool.Put(b)
+}
+
+// newPooledPacket returns a packet held by the caller, with a pooled buffer
+// in Buf
+func newPooledPacket() *packet {
+	b := getbuf()
+	return &packet{
+		Buf:  *b,
+		buf:  b,
+		refs: 1,
+	}
+}
+
+// hold p, so that the buffer of p is kept until release
+func (p *packet) hold() {
+	if p.buf != nil {
+		atomic.AddInt32(&p.refs, 1)
+	}
+}
+
+// release p, the buffer of p is put back to pool by the last holder
+func (p *packet) release() {
+	if p.buf != nil && atomic.AddInt32(&p.refs, -1) == 0 {
+		putbuf(p.buf)
+	}
 }
 
 func (p *packet) copy() *packet {
@@ -118,6 +179,7 @@ func decodePacket(b []byte, p *packet) (err error) {
 	if m <= 0 {
 		return
 	}
+	p.Buf = nil
 	if i > 0 {
 		n += m
 		p.Buf = b[n : n+int(i)]
@@ -126,63 +188,218 @@ func decodePacket(b []byte, p *packet) (err error) {
 	return nil
 }
 
+// probe is carried in Buf of ping and pong, fields are appended as uvarint
+// so that peer with fewer fields still decodes it
+type probe struct {
+	Grp   uint32 // group of the upstream on dialer side
+	Recv  uint64 // bytes received from the upstream by the sender
+	Stamp int64  // sender clock when the probe is sent
+	Echo  int64  // the last Stamp received from peer
+	Held  int64  // how long Echo had been held by the sender
+	Seq   uint64 // sequence of the probe on the upstream
+	Top   uint64 // the highest Seq received from peer
+	Got   uint64 // number of probes received from peer
+	Flags uint64 // probeUDPBlocked
+	Token uint64 // random token of the upstream, dialer only
+	Mac   uint64 // by the key shared by peers, ping only, see sign
+}
+
+// flags of probe
+const (
+	// udp is blocked by dialer, server follows it
+	probeUDPBlocked uint64 = 1 << iota
+)
+
+func (pb *probe) encode() []byte {
+	b := make([]byte, binary.MaxVarintLen64*11)
+	n := binary.PutUvarint(b, uint64(pb.Grp))
+	n += binary.PutUvarint(b[n:], pb.Recv)
+	n += binary.PutUvarint(b[n:], uint64(pb.Stamp))
+	n += binary.PutUvarint(b[n:], uint64(pb.Echo))
+	n += binary.PutUvarint(b[n:], uint64(pb.Held))
+	n += binary.PutUvarint(b[n:], pb.Seq)
+	n += binary.PutUvarint(b[n:], pb.Top)
+	n += binary.PutUvarint(b[n:], pb.Got)
+	n += binary.PutUvarint(b[n:], pb.Flags)
+	n += binary.PutUvarint(b[n:], pb.Token)
+	n += binary.PutUvarint(b[n:], pb.Mac)
+	return b[:n]
+}
+
+func decodeProbe(b []byte, pb *probe) error {
+	var v [11]uint64
+	var n int
+	for k := range v {
+		i, m := binary.Uvarint(b[n:])
+		if m <= 0 {
+			if k == 0 {
+				return errors.New("probe decode err")
+			}
+			break
+		}
+		v[k] = i
+		n += m
+	}
+	pb.Grp, pb.Recv = uint32(v[0]), v[1]
+	pb.Stamp, pb.Echo, pb.Held = int64(v[2]), int64(v[3]), int64(v[4])
+	pb.Seq, pb.Top, pb.Got = v[5], v[6], v[7]
+	pb.Flags, pb.Token, pb.Mac = v[8], v[9], v[10]
+	return nil
+}
+
+// sign pb sent by senderid with key shared by peers, so that peer knows the
+// path token and sequence of it are not forged. Nothing is signed without
+// key.
+func (pb *probe) sign(key []byte, senderid uint32) {
+	if len(key) > 0 {
+		pb.Mac = pb.mac(key, senderid)
+	}
+}
+
+// signed returns if pb is signed by senderid with key
+func (pb *probe) signed(key []byte, senderid uint32) bool {
+	if len(key) == 0 {
+		return false
+	}
+	var want, got [8]byte
+	binary.BigEndian.PutUint64(want[:], pb.mac(key, senderid))
+	binary.BigEndian.PutUint64(got[:], pb.Mac)
+	return hmac.Equal(want[:], got[:])
+}
+
+// mac of senderid, Token, Seq and Stamp of pb by key
+func (pb *probe) mac(key []byte, senderid uint32) uint64 {
+	var b [28]byte
+	binary.BigEndian.PutUint32(b[0:], senderid)
+	binary.BigEndian.PutUint64(b[4:], pb.Token)
+	binary.BigEndian.PutUint64(b[12:], pb.Seq)
+	binary.BigEndian.PutUint64(b[20:], uint64(pb.Stamp))
+	h := hmac.New(sha256.New, key)
+	h.Write(b[:])
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
+
 type queue struct {
 	*sync.Cond
-	queue        map[uint32]*packet
+	queue        ring // base of it is waitingSeqid
 	waitingSeqid uint32
 	waitTime     time.Time
 	maxseqid     uint32
 	closed       int64
+
+	// the highest seqid that every packet up to it is received, the last
+	// one acked and window advertised, when it's acked and when the last
+	// packet is received or read
+	contig  uint32
+	acked   uint32
+	ackwnd  uint32
+	acktime time.Time
+	active  time.Time
 }
 
 func newQueue() *queue {
 	return &queue{
 		Cond:         sync.NewCond(&sync.Mutex{}),
-		queue:        make(map[uint32]*packet),
+		queue:        newRing(1),
 		waitingSeqid: 1,
 	}
 }
 
 func (q *queue) len() int {
-	return len(q.queue)
+	return q.queue.n
 }
 
 func (q *queue) isClosed() bool {
 	return atomic.LoadInt64(&q.closed) != 0
 }
 
-func (q *queue) arrived() bool {
-	if q.isClosed() {
-		return true
+// window returns the highest seqid that peer may send, packets not read
+// yet are buffered up to recvwindow
+func (q *queue) window() uint32 {
+	return q.waitingSeqid - 1 + recvwindow
+}
+
+// ackdue returns the ack to send at now, nil if no ack is due. Packets
+// received in order are acked at most every ackinterval, window is
+// advertised once it moves by a quarter. The last ack is repeated every
+// ackrepeat in case it's lost, as long as the queue is active in keepalive.
+func (q *queue) ackdue(now time.Time) (seqid, wnd uint32) {
+	wnd = q.window()
+	switch {
+	case q.contig == 0:
+		return 0, 0
+	case q.contig > q.acked && now.Sub(q.acktime) >= ackinterval:
+	case wnd-q.ackwnd >= recvwindow/4:
+	case now.Sub(q.acktime) >= ackrepeat && now.Sub(q.active) < keepalive:
+	default:
+		return 0, 0
 	}
+	q.acked, q.ackwnd, q.acktime = q.contig, wnd, now
+	return q.contig, wnd
+}
 
-	if _, exist := q.queue[q.waitingSeqid]; exist {
+func (q *queue) arrived() bool {
+	if q.isClosed() {
 		return true
 	}
 
-	return false
+	return q.queue.get(q.waitingSeqid) != nil
 }
 
+// packetQueue holds queues of connections in connshards shards by key, so
+// that lookups of different connections don't contend on one lock
 type packetQueue struct {
-	queues map[uint64]*queue
-	mux    sync.RWMutex
+	shards [connshards]queueShard
 	popudp uint64
 	poptcp uint64
 }
 
+type queueShard struct {
+	sync.RWMutex
+	queues map[uint64]*queue
+}
+
 func newPacketQueue() *packetQueue {
-	return &packetQueue{
-		queues: make(map[uint64]*queue),
+	pq := &packetQueue{}
+	for i := range pq.shards {
+		pq.shards[i].queues = make(map[uint64]*queue)
+	}
+	return pq
+}
+
+func (pq *packetQueue) shard(key uint64) *queueShard {
+	return &pq.shards[key%connshards]
+}
+
+// get returns the queue of connection, nil if there is none
+func (pq *packetQueue) get(senderid, connid uint32) *queue {
+	key := packetKey(senderid, connid)
+	sh := pq.shard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	return sh.queues[key]
+}
+
+// each calls f with every queue and its key, shard of it is read locked
+func (pq *packetQueue) each(f func(key uint64, q *queue)) {
+	for i := range pq.shards {
+		sh := &pq.shards[i]
+		sh.RLock()
+		for k, v := range sh.queues {
+			f(k, v)
+		}
+		sh.RUnlock()
 	}
 }
 
 func (pq *packetQueue) create(senderid, connid uint32) (isnew bool) {
 	key := packetKey(senderid, connid)
+	sh := pq.shard(key)
 
-	pq.mux.Lock()
-	defer pq.mux.Unlock()
-	if _, exist := pq.queues[key]; !exist {
-		pq.queues[key] = newQueue()
+	sh.Lock()
+	defer sh.Unlock()
+	if _, exist := sh.queues[key]; !exist {
+		sh.queues[key] = newQueue()
 		return true
 	}
 	return false
@@ -191,10 +408,8 @@ func (pq *packetQueue) create(senderid, connid uint32) (isnew bool) {
 func (pq *packetQueue) close(senderid, connid uint32) {
 	key := packetKey(senderid, connid)
 	// TODO: wait queue drained cleanedup?
-	pq.mux.Lock()
-	q, exist := pq.queues[key]
-	pq.mux.Unlock()
-	if exist && q != nil {
+	q := pq.get(senderid, connid)
+	if q != nil {
 		// set q.queue = nil ?
 		atomic.StoreInt64(&q.closed, 1)
 		q.Broadcast()
@@ -203,66 +418,95 @@ func (pq *packetQueue) close(senderid, connid uint32) {
 			// expired after 30 minutes
 			<-time.After(30 * time.Minute)
 
-			pq.mux.Lock()
-
-			delete(pq.queues, key)
-			pq.mux.Unlock()
+			sh := pq.shard(key)
+			sh.Lock()
+			delete(sh.queues, key)
+			sh.Unlock()
 		}()
 	}
 }
 
 func (pq *packetQueue) len() (n int) {
-	pq.mux.RLock()
-	defer pq.mux.RUnlock()
-	for _, v := range pq.queues {
+	pq.each(func(_ uint64, v *queue) {
 		v.L.Lock()
-		n += len(v.queue)
+		n += v.len()
 		v.L.Unlock()
-	}
+	})
 	return
 }
 
-func (pq *packetQueue) add(p *packet) (waitingSeqid uint32) {
-	key := packetKey(p.Senderid, p.Connid)
+// newAck returns ack of packets up to seqid, with window the highest seqid
+// that peer may send
+func newAck(senderid, connid, seqid, wnd uint32) *packet {
+	buf := make([]byte, binary.MaxVarintLen32)
+	return &packet{
+		Senderid: senderid,
+		Connid:   connid,
+		Seqid:    seqid,
+		Cmd:      ack,
+		Buf:      buf[:binary.PutUvarint(buf, uint64(wnd))],
+		udp:      true,
+		Time:     time.Now().UnixNano(),
+	}
+}
+
+// ackWindow returns the window of ack p, ack of peer that doesn't advertise
+// window doesn't limit sender
+func ackWindow(p *packet) uint32 {
+	wnd, n := binary.Uvarint(p.Buf)
+	if n <= 0 {
+		return ^uint32(0)
+	}
+	return uint32(wnd)
+}
 
-	pq.mux.Lock()
-	q, exist := pq.queues[key]
-	pq.mux.Unlock()
+// add p to the queue, returns the ack to send if an ack is due. Packets
+// beyond window or received already are dropped and released.
+func (pq *packetQueue) add(p *packet) (a *packet) {
+	kept := false
+	defer func() {
+		if !kept {
+			p.release()
+		}
+	}()
 
-	if exist && q != nil {
+	q := pq.get(p.Senderid, p.Connid)
+	if q != nil {
 		q.L.Lock()
-		_, ok := q.queue[p.Seqid]
-		if p.Seqid >= q.waitingSeqid && !ok {
-			q.queue[p.Seqid] = p
+		if p.Seqid > q.window() {
+			logrus.WithFields(logrus.Fields{
+				"Connid": p.Connid,
+				"Seqid":  p.Seqid,
+				"window": q.window(),
+			}).Debugln("packet beyond window, dropping")
+		} else if q.queue.put(p) {
+			kept = true
 			defer q.Broadcast()
 
-			waitingSeqid = q.waitingSeqid
-
 			if p.Seqid > q.maxseqid {
 				q.maxseqid = p.Seqid
 			}
+			for q.queue.get(q.contig+1) != nil {
+				q.contig++
+			}
+			q.active = time.Now()
+			if seqid, wnd := q.ackdue(q.active); seqid != 0 {
+				a = newAck(p.Senderid, p.Connid, seqid, wnd)
+			}
 		}
 		q.L.Unlock()
 	} else {
 		logrus.WithFields(logrus.Fields{
 			"packet": p,
-			"exist":  exist,
-			"q":      q,
-			"key":    key,
-			"pq":     pq,
+			"key":    packetKey(p.Senderid, p.Connid),
 		}).Warnln("packetQueue havn't been created, dropping")
 	}
 	return
 }
 
 func (pq *packetQueue) waitforArrived(senderid, connid uint32) {
-	key := packetKey(senderid, connid)
-
-	pq.mux.Lock()
-	q, exist := pq.queues[key]
-	pq.mux.Unlock()
-
-	if exist && q != nil {
+	q := pq.get(senderid, connid)
+	if q != nil {
 		q.L.Lock()
 		for !q.arrived() {
 			q.Wait()
@@ -273,43 +517,48 @@ func (pq *packetQueue) waitforArrived(senderid, connid uint32) {
 	}
 }
 
-func (pq *packetQueue) isClosed(senderid, connid uint32) bool {
-	key := packetKey(senderid, connid)
+// ackdue returns the ack of the queue if it's due, eg. the window is moved
+// by the reader
+func (pq *packetQueue) ackdue(senderid, connid uint32) *packet {
+	q := pq.get(senderid, connid)
+	if q != nil {
+		q.L.Lock()
+		defer q.L.Unlock()
+		if seqid, wnd := q.ackdue(time.Now()); seqid != 0 {
+			return newAck(senderid, connid, seqid, wnd)
+		}
+	}
+	return nil
+}
 
-	pq.mux.Lock()
-	q, exist := pq.queues[key]
-	pq.mux.Unlock()
-	if exist && q != nil {
+func (pq *packetQueue) isClosed(senderid, connid uint32) bool {
+	q := pq.get(senderid, connid)
+	if q != nil {
 		return q.isClosed()
 	}
 	return true
 }
 
+// pop the next packet in order, the caller releases it
 func (pq *packetQueue) pop(senderid, connid uint32) *packet {
-	key := packetKey(senderid, connid)
-
-	pq.mux.Lock()
-	q, exist := pq.queues[key]
-	pq.mux.Unlock()
-
-	if exist && q != nil {
+	q := pq.get(senderid, connid)
+	if q != nil {
 		// TODO: closed?
 		// if q.isClosed() {
 		// 	return nil
 		// }
 
 		q.L.Lock()
-		p, exist := q.queue[q.waitingSeqid]
-		if exist {
-			delete(q.queue, q.waitingSeqid)
-			if _, ok := q.queue[q.waitingSeqid]; ok {
-				delete(q.queue, q.waitingSeqid)
-			}
+		p := q.queue.get(q.waitingSeqid)
+		if p != nil {
 			q.waitingSeqid++
+			q.queue.advance(q.waitingSeqid, nil)
 			q.waitTime = time.Now()
+			q.active = q.waitTime
 			q.L.Unlock()
 			defer q.Broadcast()
 			if p.Cmd == close || p.Cmd == closed {
+				p.release()
 				pq.close(senderid, connid)
 				return nil
 			}
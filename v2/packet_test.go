@@ -2,6 +2,7 @@ package trafcacc
 
 import (
 	"fmt"
+	"net"
 	"reflect"
 	"sync"
 	"testing"
@@ -10,7 +11,7 @@ import (
 
 func TestPacket(t *testing.T) {
 	now := time.Now().UnixNano()
-	p0 := &packet{1, 2, 3, []byte("12"), close, false, now, sync.RWMutex{}}
+	p0 := &packet{1, 2, 3, []byte("12"), close, false, now, sync.RWMutex{}, nil, 0, nil, 0}
 	udpbuf := make([]byte, buffersize)
 
 	n := p0.encode(udpbuf)
@@ -24,3 +25,96 @@ func TestPacket(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestProbe(t *testing.T) {
+	now := time.Now().UnixNano()
+	pb0 := probe{Grp: 2, Recv: 1 << 40, Stamp: now, Echo: now - 1000, Held: 300, Seq: 7, Top: 6, Got: 5, Flags: probeUDPBlocked, Token: 1 << 63}
+	pb0.sign([]byte("key"), 9)
+	pb1 := probe{}
+	if err := decodeProbe(pb0.encode(), &pb1); err != nil || pb1 != pb0 {
+		t.Fatal(err, pb1, pb0)
+	}
+
+	// signed by sender with the key only
+	if !pb1.signed([]byte("key"), 9) || pb1.signed([]byte("other"), 9) || pb1.signed([]byte("key"), 8) || pb1.signed(nil, 9) {
+		t.Fatal("expect probe signed by sender 9 with key")
+	}
+	pb1.Seq++
+	if pb1.signed([]byte("key"), 9) {
+		t.Fatal("expect probe of forged Seq not signed")
+	}
+
+	// probe from peer that has fewer fields
+	old := (&probe{Grp: 3, Recv: 10}).encode()[:2]
+	pb1 = probe{}
+	if err := decodeProbe(old, &pb1); err != nil || pb1 != (probe{Grp: 3, Recv: 10}) {
+		t.Fatal(err, pb1)
+	}
+}
+
+func TestPacketRelease(t *testing.T) {
+	pq := newPacketQueue()
+	pq.create(1, 1)
+
+	// packet queued is held until it's popped and released, the one
+	// received already is released at once
+	p := newPooledPacket()
+	p.Senderid, p.Connid, p.Seqid = 1, 1, 1
+	p.Buf = p.Buf[:10]
+	pq.add(p)
+	dup := newPooledPacket()
+	dup.Senderid, dup.Connid, dup.Seqid = 1, 1, 1
+	pq.add(dup)
+	if p.refs != 1 || dup.refs != 0 {
+		t.Fatal("expect queued packet held and duplicate released", p.refs, dup.refs)
+	}
+
+	// cache and sendq hold it on their own
+	c := newWriteCache()
+	c.add(p)
+	p.hold()
+	if p.refs != 3 {
+		t.Fatal("expect packet held by cache", p.refs)
+	}
+	p.release()
+	c.ack(1, 1, 1, recvwindow)
+	if p.refs != 1 {
+		t.Fatal("expect acked packet released by cache", p.refs)
+	}
+	if pq.pop(1, 1) != p {
+		t.Fatal("expect packet popped")
+	}
+	p.release()
+	if p.refs != 0 {
+		t.Fatal("expect packet released", p.refs)
+	}
+}
+
+func TestSendpacketAllocs(t *testing.T) {
+	l, err := net.ListenUDP(udp, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.DialUDP(udp, nil, l.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	u := newUpstream(udp)
+	u.conn = conn
+	p := newPooledPacket()
+	p.Buf = p.Buf[:mtu]
+	defer p.release()
+
+	// the buffer to encode in is taken from pool
+	b := make([]byte, buffersize)
+	n := testing.AllocsPerRun(100, func() {
+		u.sendpacket(p)
+		l.Read(b)
+	})
+	if n > 0 {
+		t.Fatal("expect udp send not allocate per packet", n)
+	}
+}
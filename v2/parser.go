@@ -4,70 +4,215 @@ package trafcacc
 
 import (
 	"net"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
-
-	log "github.com/Sirupsen/logrus"
 )
 
-type endpoint struct {
-	proto     string
-	host      string
-	portBegin int // port begin
-	portEnd   int // port end
+// Endpoint is one of the comma separated addresses in the form of
+//
+//	proto://host:ports[?option=value&...]
+//
+// host can be an IPv6 literal in brackets, ports is a "+" separated list
+// of single ports or port ranges, eg. udp://[2001:db8::1]:5000-5010+6000.
+// Options are:
+//
+//	weight=3         scheduler weight of each upstream, default 1
+//	group=isp-a      name of the path group the upstreams belong to
+//	bind=10.0.0.2    local address the upstreams are dialed from
+type Endpoint struct {
+	Proto  string
+	Host   string
+	Ports  []PortRange
+	Weight int
+	Group  string
+	Bind   string
 }
 
-// parse 分析输入的控制参数
-func parse(s string) (e []endpoint) {
-	x := strings.Split(s, ",")
-	if len(x) < 1 {
-		log.Fatal("argument error", s)
-	}
+// PortRange is a range of ports, both ends included
+type PortRange struct {
+	Begin int
+	End   int
+}
 
-	for _, s0 := range x {
-		e0 := endpoint{}
-		x0 := strings.Split(s0, "://")
-		if len(x0) < 2 {
-			log.Fatal("argument error", s0)
+// Addrs returns host:port of every port of the endpoint
+func (e *Endpoint) Addrs() (addrs []string) {
+	for _, r := range e.Ports {
+		for p := r.Begin; p <= r.End; p++ {
+			addrs = append(addrs, net.JoinHostPort(e.Host, strconv.Itoa(p)))
 		}
-		switch x0[0] {
-		case tcp:
-		case udp:
-		default:
-			log.Fatal("unknown proto:", x0[0])
-		}
-		e0.proto = x0[0]
-		h, p, err := net.SplitHostPort(x0[1])
+	}
+	return
+}
+
+// groupname returns the group option, or the endpoint itself if there is no
+// group option, so that every endpoint is a group of its own by default
+func (e *Endpoint) groupname() string {
+	if len(e.Group) > 0 {
+		return e.Group
+	}
+	ports := make([]string, len(e.Ports))
+	for i, r := range e.Ports {
+		ports[i] = strconv.Itoa(r.Begin) + "-" + strconv.Itoa(r.End)
+	}
+	return "#" + e.key(net.JoinHostPort(e.Host, strings.Join(ports, "+")))
+}
+
+// options returns options of the endpoint in canonical form
+func (e *Endpoint) options() string {
+	v := url.Values{}
+	if e.Weight != 1 {
+		v.Set("weight", strconv.Itoa(e.Weight))
+	}
+	if len(e.Group) > 0 {
+		v.Set("group", e.Group)
+	}
+	if len(e.Bind) > 0 {
+		v.Set("bind", e.Bind)
+	}
+	return v.Encode()
+}
+
+// key identifies the upstream or listener of addr with the endpoint options
+func (e *Endpoint) key(addr string) string {
+	k := e.Proto + "://" + addr
+	if opts := e.options(); len(opts) > 0 {
+		k += "?" + opts
+	}
+	return k
+}
+
+// ParseEndpoints 分析输入的控制参数, s is comma separated Endpoint
+func ParseEndpoints(s string) (e []Endpoint, err error) {
+	if len(strings.TrimSpace(s)) == 0 {
+		return nil, &ParseError{Arg: s, Msg: "empty argument"}
+	}
+
+	for _, s0 := range strings.Split(s, ",") {
+		e0, err := parseEndpoint(strings.TrimSpace(s0))
 		if err != nil {
-			log.Fatal("argument", x0[1], "error:", err)
+			return nil, err
 		}
-		e0.host = h
-
-		e0.parseports(p)
 		e = append(e, e0)
 	}
-	return e
+	return e, nil
+}
+
+func parseEndpoint(s string) (e Endpoint, err error) {
+	e.Weight = 1
+
+	x := strings.SplitN(s, "://", 2)
+	if len(x) < 2 {
+		return e, &ParseError{Arg: s, Msg: "argument error"}
+	}
+	switch x[0] {
+	case tcp:
+	case udp:
+	default:
+		return e, &ParseError{Arg: s, Msg: "unknown proto " + x[0]}
+	}
+	e.Proto = x[0]
+
+	hostport, query := x[1], ""
+	if i := strings.Index(hostport, "?"); i >= 0 {
+		hostport, query = hostport[:i], hostport[i+1:]
+	}
+
+	h, p, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return e, &ParseError{Arg: s, Msg: "argument error", Err: err}
+	}
+	e.Host = h
+
+	if e.Ports, err = parsePorts(p); err != nil {
+		return e, err
+	}
+
+	if err := e.parseOptions(query); err != nil {
+		return e, err
+	}
+	return e, nil
 }
 
-func (e0 *endpoint) parseports(p string) {
-	var err error
+// parsePorts parse "+" separated ports or port ranges
+func parsePorts(p string) (r []PortRange, err error) {
+	for _, p0 := range strings.Split(p, "+") {
+		x := strings.Split(p0, "-")
+		if len(x) > 2 {
+			return nil, &ParseError{Arg: p0, Msg: "argument port error"}
+		}
+
+		r0 := PortRange{}
+		if r0.Begin, err = parsePort(x[0]); err != nil {
+			return nil, err
+		}
+		r0.End = r0.Begin
+		if len(x) == 2 {
+			if r0.End, err = parsePort(x[1]); err != nil {
+				return nil, err
+			}
+		}
+		if r0.End < r0.Begin {
+			return nil, &ParseError{Arg: p0, Msg: "argument port range error"}
+		}
+		r = append(r, r0)
+	}
+	return r, nil
+}
 
-	x1 := strings.Split(p, "-")
-	if len(x1) < 1 {
-		log.Fatal("argument port", p)
+func parsePort(p string) (int, error) {
+	n, err := strconv.Atoi(p)
+	if err != nil {
+		return 0, &ParseError{Arg: p, Msg: "argument port error", Err: err}
+	}
+	if n < 0 || n > 65535 {
+		return 0, &ParseError{Arg: p, Msg: "argument port out of range"}
 	}
+	return n, nil
+}
 
-	e0.portBegin, err = strconv.Atoi(x1[0])
+func (e *Endpoint) parseOptions(query string) error {
+	if len(query) == 0 {
+		return nil
+	}
+	v, err := url.ParseQuery(query)
 	if err != nil {
-		log.Fatal("argument port begin ", x1[0], "error:", err)
+		return &ParseError{Arg: query, Msg: "argument option error", Err: err}
 	}
 
-	if len(x1) < 2 {
-		e0.portEnd = e0.portBegin
-	} else {
-		e0.portEnd, err = strconv.Atoi(x1[1])
-		if err != nil {
-			log.Fatal("argument port end ", x1[1], "error:", err)
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		val := v.Get(k)
+		switch k {
+		case "weight":
+			w, err := strconv.Atoi(val)
+			if err != nil || w < 1 {
+				return &ParseError{Arg: query, Msg: "argument weight error", Err: err}
+			}
+			e.Weight = w
+		case "group":
+			if len(val) == 0 {
+				return &ParseError{Arg: query, Msg: "argument group is empty"}
+			}
+			e.Group = val
+		case "bind":
+			h := val
+			if sh, _, err := net.SplitHostPort(val); err == nil {
+				h = sh
+			}
+			if net.ParseIP(h) == nil {
+				return &ParseError{Arg: query, Msg: "argument bind is not an ip address"}
+			}
+			e.Bind = val
+		default:
+			return &ParseError{Arg: query, Msg: "unknown option " + k}
 		}
 	}
+	return nil
 }
@@ -1,45 +1,75 @@
 package trafcacc
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 func TestFlags(t *testing.T) {
-
-	if !testEq(parse("tcp://:5000"),
-		[]endpoint{endpoint{proto: "tcp", portBegin: 5000, portEnd: 5000}}) {
-		t.Fail()
-	}
-
-	if !testEq(parse("udp://127.0.0.1:5000-6000"),
-		[]endpoint{endpoint{proto: "udp", host: "127.0.0.1", portBegin: 5000, portEnd: 6000}}) {
-		t.Fail()
+	tests := []struct {
+		in  string
+		out []Endpoint
+	}{
+		{"tcp://:5000",
+			[]Endpoint{{Proto: tcp, Ports: []PortRange{{5000, 5000}}, Weight: 1}}},
+		{"udp://127.0.0.1:5000-6000",
+			[]Endpoint{{Proto: udp, Host: "127.0.0.1", Ports: []PortRange{{5000, 6000}}, Weight: 1}}},
+		{"udp://127.0.0.1:2000-2100,tcp://192.168.1.1:2000-2050",
+			[]Endpoint{{Proto: udp, Host: "127.0.0.1", Ports: []PortRange{{2000, 2100}}, Weight: 1},
+				{Proto: tcp, Host: "192.168.1.1", Ports: []PortRange{{2000, 2050}}, Weight: 1}}},
+		{"udp://[2001:db8::1]:5000-5010?weight=3&group=isp-a&bind=10.0.0.2",
+			[]Endpoint{{Proto: udp, Host: "2001:db8::1", Ports: []PortRange{{5000, 5010}},
+				Weight: 3, Group: "isp-a", Bind: "10.0.0.2"}}},
+		{"udp://[::1]:5000-5002+5005+6000-6001?bind=[::1]:0",
+			[]Endpoint{{Proto: udp, Host: "::1", Ports: []PortRange{{5000, 5002}, {5005, 5005}, {6000, 6001}},
+				Weight: 1, Bind: "[::1]:0"}}},
+		{"tcp://a.example:80?group=b, udp://b.example:53",
+			[]Endpoint{{Proto: tcp, Host: "a.example", Ports: []PortRange{{80, 80}}, Weight: 1, Group: "b"},
+				{Proto: udp, Host: "b.example", Ports: []PortRange{{53, 53}}, Weight: 1}}},
 	}
 
-	if !testEq(parse("udp://127.0.0.1:2000-2100,tcp://192.168.1.1:2000-2050"),
-		[]endpoint{endpoint{proto: udp, host: "127.0.0.1", portBegin: 2000, portEnd: 2100},
-			endpoint{proto: tcp, host: "192.168.1.1", portBegin: 2000, portEnd: 2050}}) {
-		t.Fail()
+	for _, tt := range tests {
+		e, err := ParseEndpoints(tt.in)
+		if err != nil || !reflect.DeepEqual(e, tt.out) {
+			t.Errorf("ParseEndpoints(%q) = %v, %v; want %v", tt.in, e, err, tt.out)
+		}
 	}
 }
 
-func testEq(a, b []endpoint) bool {
-
-	if a == nil && b == nil {
-		return true
-	}
-
-	if a == nil || b == nil {
-		return false
+func TestFlagsError(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"127.0.0.1:5000",
+		"sctp://127.0.0.1:5000",
+		"udp://127.0.0.1",
+		"udp://2001:db8::1:5000",
+		"udp://127.0.0.1:a-6000",
+		"udp://127.0.0.1:5000-b",
+		"udp://127.0.0.1:6000-5000",
+		"udp://127.0.0.1:5000-5001-5002",
+		"udp://127.0.0.1:5000+",
+		"udp://127.0.0.1:70000",
+		"udp://127.0.0.1:5000?weight=0",
+		"udp://127.0.0.1:5000?weight=x",
+		"udp://127.0.0.1:5000?group=",
+		"udp://127.0.0.1:5000?bind=localhost",
+		"udp://127.0.0.1:5000?foo=bar",
+		"udp://127.0.0.1:5000,",
+	} {
+		_, err := ParseEndpoints(s)
+		if _, ok := err.(*ParseError); !ok {
+			t.Errorf("ParseEndpoints(%q) expect ParseError, got %v", s, err)
+		}
 	}
+}
 
-	if len(a) != len(b) {
-		return false
+func TestEndpointAddrs(t *testing.T) {
+	e, err := ParseEndpoints("udp://[::1]:5000-5001+6000")
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	for i := range a {
-		if a[i] != b[i] {
-			return false
-		}
+	want := []string{"[::1]:5000", "[::1]:5001", "[::1]:6000"}
+	if addrs := e[0].Addrs(); !reflect.DeepEqual(addrs, want) {
+		t.Errorf("Addrs() = %v; want %v", addrs, want)
 	}
-
-	return true
 }
@@ -0,0 +1,79 @@
+package trafcacc
+
+// ring of packets indexed by seqid, it holds packets of seqid in
+// [base, base+len(buf)) and grows when a packet beyond is put. len(buf) is
+// always a power of two.
+type ring struct {
+	buf  []*packet
+	base uint32
+	n    int // number of packets held
+}
+
+func newRing(base uint32) ring {
+	return ring{
+		buf:  make([]*packet, ringsize),
+		base: base,
+	}
+}
+
+func (r *ring) slot(seqid uint32) *(*packet) {
+	return &r.buf[seqid&uint32(len(r.buf)-1)]
+}
+
+func (r *ring) inrange(seqid uint32) bool {
+	return seqid >= r.base && seqid-r.base < uint32(len(r.buf))
+}
+
+// get returns the packet of seqid, nil if there is none
+func (r *ring) get(seqid uint32) *packet {
+	if !r.inrange(seqid) {
+		return nil
+	}
+	return *r.slot(seqid)
+}
+
+// put p, returns false if it's below base or there is one of its seqid
+func (r *ring) put(p *packet) bool {
+	if p.Seqid < r.base {
+		return false
+	}
+	for !r.inrange(p.Seqid) {
+		r.grow()
+	}
+	s := r.slot(p.Seqid)
+	if *s != nil {
+		return false
+	}
+	*s = p
+	r.n++
+	return true
+}
+
+// advance base to seqid, packets below it are removed and passed to f if f
+// is not nil
+func (r *ring) advance(seqid uint32, f func(*packet)) {
+	for ; r.base < seqid && r.n > 0; r.base++ {
+		s := r.slot(r.base)
+		if *s != nil {
+			if f != nil {
+				f(*s)
+			}
+			*s = nil
+			r.n--
+		}
+	}
+	if r.base < seqid {
+		r.base = seqid
+	}
+}
+
+// grow doubles the buffer, packets are moved to their slots of it
+func (r *ring) grow() {
+	old := r.buf
+	r.buf = make([]*packet, len(old)*2)
+	for _, p := range old {
+		if p != nil {
+			*r.slot(p.Seqid) = p
+		}
+	}
+}
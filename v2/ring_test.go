@@ -0,0 +1,43 @@
+package trafcacc
+
+import "testing"
+
+func TestRing(t *testing.T) {
+	r := newRing(1)
+	if r.put(&packet{Seqid: 0}) {
+		t.Fatal("expect packet below base rejected")
+	}
+	for seqid := uint32(1); seqid <= ringsize*3; seqid += 2 {
+		if !r.put(&packet{Seqid: seqid}) {
+			t.Fatal("expect packet put", seqid)
+		}
+	}
+	if r.put(&packet{Seqid: 3}) {
+		t.Fatal("expect duplicated packet rejected")
+	}
+	if len(r.buf) != ringsize*4 || r.n != ringsize*3/2 {
+		t.Fatal("expect ring grown", len(r.buf), r.n)
+	}
+	if p := r.get(ringsize + 1); p == nil || p.Seqid != ringsize+1 {
+		t.Fatal("expect packet kept when grown", p)
+	}
+	if r.get(2) != nil || r.get(ringsize*8) != nil {
+		t.Fatal("expect nil of seqid not put")
+	}
+
+	var n int
+	r.advance(ringsize+2, func(p *packet) { n++ })
+	if n != ringsize/2+1 || r.n != ringsize-1 || r.base != ringsize+2 || r.get(ringsize+1) != nil {
+		t.Fatal("expect packets below base removed", n, r.n, r.base)
+	}
+
+	// slots are reused after base moved
+	r.advance(ringsize*3+1, nil)
+	if r.n != 0 || !r.put(&packet{Seqid: ringsize * 6}) || r.get(ringsize*6) == nil {
+		t.Fatal("expect empty ring reused", r.n)
+	}
+	r.advance(1<<30, nil)
+	if r.n != 0 || r.base != 1<<30 {
+		t.Fatal("expect base moved at once in empty ring", r.n, r.base)
+	}
+}
@@ -0,0 +1,323 @@
+package trafcacc
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// Path is an alive upstream tunnel that a packet can be sent on
+type Path interface {
+	Proto() string
+	Group() int
+	Weight() int
+	RTT() time.Duration
+	Loss() float64     // round trip
+	LossIn() float64   // from peer
+	LossOut() float64  // to peer
+	Bandwidth() uint64 // bytes per second
+}
+
+// PacketInfo describes the packet that is going to be scheduled
+type PacketInfo struct {
+	Control bool // not data but ack, rqu, connect, close etc.
+	UDP     bool // prefer udp, eg. ack
+	Size    int
+	Copies  int // redundancy factor suggested by measured loss, 1 to 3
+
+	// the packet is sent before, paths are those disjoint from the ones it
+	// was sent on if there is any
+	Retransmit bool
+}
+
+// Scheduler picks the paths that a packet is sent on. paths are ranked from
+// the best to the worst by RTT and loss, they are shared by concurrent calls
+// of Pick and must not be modified, eg. sorted in place, nor retained after
+// Pick returns.
+type Scheduler interface {
+	Pick(p PacketInfo, paths []Path) []Path
+}
+
+// pathScore of path by RTT and loss of packets sent on it, the lower the
+// better
+func pathScore(p Path) int64 {
+	rtt := int64(p.RTT() + time.Millisecond)
+	return rtt + int64(float64(rtt)*p.LossOut()*lossfactor)
+}
+
+// NewRedundantScheduler returns the default scheduler. It sends the primary
+// copy of a packet on one of the best paths, and the redundant copies on the
+// best paths of other groups. When there are both udp and tcp paths, the
+// primary copy goes to udp and the first redundant one goes to tcp. Number of
+// copies follows PacketInfo.Copies, packets prefer udp are sent only once.
+func NewRedundantScheduler() Scheduler {
+	return &redundantScheduler{}
+}
+
+type redundantScheduler struct {
+	rn uint32
+}
+
+func (s *redundantScheduler) Pick(p PacketInfo, paths []Path) []Path {
+	var hasudp, hastcp bool
+	for _, v := range paths {
+		switch v.Proto() {
+		case udp:
+			hasudp = true
+		case tcp:
+			hastcp = true
+		}
+	}
+
+	copies := p.Copies
+	if copies <= 0 {
+		copies = 2
+	}
+
+	rn := int(atomic.AddUint32(&s.rn, 1) - 1)
+	var picked []Path
+	switch {
+	case len(paths) == 0:
+		return nil
+	case p.UDP && hasudp:
+		return []Path{pickbest(paths, udp, rn)}
+	case hasudp && hastcp:
+		first := pickbest(paths, udp, rn)
+		if copies == 1 {
+			return []Path{first}
+		}
+		picked = pathpair(first, pickdiverse(paths, tcp, first))
+	default:
+		first := pickbest(paths, "", rn)
+		if copies == 1 {
+			return []Path{first}
+		}
+		picked = pathpair(first, pickdiverse(paths, "", first))
+	}
+	if copies > len(picked) {
+		picked = pickmore(paths, picked, copies)
+	}
+	return picked
+}
+
+// pickbest returns one of the paths of proto that are as good as the best
+// one, by weighted round robin. Empty proto matches any path.
+func pickbest(paths []Path, proto string, rn int) Path {
+	var best int64 = -1
+	var total int
+	for _, v := range paths {
+		if len(proto) > 0 && v.Proto() != proto {
+			continue
+		}
+		score := pathScore(v)
+		if best < 0 {
+			best = score
+		} else if score > best+best/10+int64(time.Millisecond) {
+			break
+		}
+		total += v.Weight()
+	}
+	if total == 0 {
+		return nil
+	}
+
+	n := rn % total
+	for _, v := range paths {
+		if len(proto) > 0 && v.Proto() != proto {
+			continue
+		}
+		if n -= v.Weight(); n < 0 {
+			return v
+		}
+	}
+	return nil
+}
+
+// pickdiverse returns the best path of proto that is in a different group
+// from u. If all of them are in the group of u, returns the best one that
+// is not u.
+func pickdiverse(paths []Path, proto string, u Path) Path {
+	var fallback Path
+	for _, v := range paths {
+		if v == u || (len(proto) > 0 && v.Proto() != proto) {
+			continue
+		}
+		if v.Group() != u.Group() {
+			return v
+		}
+		if fallback == nil {
+			fallback = v
+		}
+	}
+	return fallback
+}
+
+func pathpair(first, second Path) []Path {
+	if second == nil || second == first {
+		return []Path{first}
+	}
+	return []Path{first, second}
+}
+
+// NewRoundRobinScheduler returns a scheduler that stripes packets over all
+// the paths in turn, one copy per packet
+func NewRoundRobinScheduler() Scheduler {
+	return &roundRobinScheduler{}
+}
+
+type roundRobinScheduler struct {
+	rn uint32
+}
+
+func (s *roundRobinScheduler) Pick(p PacketInfo, paths []Path) []Path {
+	if len(paths) == 0 {
+		return nil
+	}
+	rn := int(atomic.AddUint32(&s.rn, 1) - 1)
+	return []Path{paths[rn%len(paths)]}
+}
+
+// NewMinRTTScheduler returns a scheduler that sends every packet once on the
+// path of the lowest RTT
+func NewMinRTTScheduler() Scheduler {
+	return minRTTScheduler{}
+}
+
+type minRTTScheduler struct{}
+
+func (minRTTScheduler) Pick(p PacketInfo, paths []Path) []Path {
+	var best Path
+	for _, v := range paths {
+		if best == nil || v.RTT() < best.RTT() {
+			best = v
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return []Path{best}
+}
+
+// NewWeightedRandomScheduler returns a scheduler that sends every packet once
+// on a random path, chosen in proportion to the path weight
+func NewWeightedRandomScheduler() Scheduler {
+	return weightedRandomScheduler{}
+}
+
+type weightedRandomScheduler struct{}
+
+func (weightedRandomScheduler) Pick(p PacketInfo, paths []Path) []Path {
+	var total int
+	for _, v := range paths {
+		total += v.Weight()
+	}
+	if total == 0 {
+		return nil
+	}
+	n := rand.Intn(total)
+	for _, v := range paths {
+		if n -= v.Weight(); n < 0 {
+			return []Path{v}
+		}
+	}
+	return nil
+}
+
+// NewBondingScheduler returns a scheduler that aggregates bandwidth of the
+// paths instead of duplicating packets. Data packets are sent once, striped
+// over the paths in proportion to their estimated bandwidth, lost ones are
+// recovered by retransmits. Control packets are picked like the redundant
+// scheduler does.
+func NewBondingScheduler() Scheduler {
+	return &bondingScheduler{}
+}
+
+type bondingScheduler struct {
+	redundantScheduler
+}
+
+func (s *bondingScheduler) Pick(p PacketInfo, paths []Path) []Path {
+	if p.Control || len(paths) == 0 {
+		return s.redundantScheduler.Pick(p, paths)
+	}
+
+	// every path takes a share of the mean bandwidth on top of its own, so
+	// that path of low estimate is still probed with some traffic
+	var sum uint64
+	for _, v := range paths {
+		sum += v.Bandwidth()
+	}
+	floor := sum/uint64(len(paths))/bondprobe + 1
+	n := rand.Int63n(int64(sum + floor*uint64(len(paths))))
+	for _, v := range paths {
+		if n -= int64(v.Bandwidth() + floor); n < 0 {
+			return []Path{v}
+		}
+	}
+	return []Path{paths[0]}
+}
+
+// NewRedundantNScheduler returns a scheduler that sends n copies of every
+// packet on the best paths, one group per copy as long as there are groups
+// left
+func NewRedundantNScheduler(n int) Scheduler {
+	if n < 1 {
+		n = 1
+	}
+	return redundantNScheduler{n: n}
+}
+
+type redundantNScheduler struct {
+	n int
+}
+
+func (s redundantNScheduler) Pick(p PacketInfo, paths []Path) []Path {
+	return pickmore(paths, nil, s.n)
+}
+
+// pickmore add the best paths to picked until there are n of them, one per
+// group that is not picked yet first
+func pickmore(paths []Path, picked []Path, n int) []Path {
+	if n > len(paths) {
+		n = len(paths)
+	}
+
+	// the best one of each group
+	for _, v := range paths {
+		if len(picked) >= n {
+			return picked
+		}
+		if !hasGroup(picked, v.Group()) && !hasPath(picked, v) {
+			picked = append(picked, v)
+		}
+	}
+
+	// then the rest in rank order
+	for _, v := range paths {
+		if len(picked) >= n {
+			break
+		}
+		if !hasPath(picked, v) {
+			picked = append(picked, v)
+		}
+	}
+	return picked
+}
+
+func hasGroup(paths []Path, grp int) bool {
+	for _, v := range paths {
+		if v.Group() == grp {
+			return true
+		}
+	}
+	return false
+}
+
+func hasPath(paths []Path, p Path) bool {
+	for _, v := range paths {
+		if v == p {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package trafcacc
+
+import (
+	"testing"
+	"time"
+)
+
+func testPaths() []Path {
+	var paths []Path
+	for i, rtt := range []int{10, 20, 30, 40} {
+		u := testUpstream(udp, i%2)
+		u.srtt = int64(time.Duration(rtt) * time.Millisecond)
+		u.weight = i + 1
+		paths = append(paths, u)
+	}
+	return paths
+}
+
+func TestRoundRobinScheduler(t *testing.T) {
+	paths := testPaths()
+	s := NewRoundRobinScheduler()
+	count := make(map[Path]int)
+	for i := 0; i < 40; i++ {
+		picked := s.Pick(PacketInfo{}, paths)
+		if len(picked) != 1 {
+			t.Fatal("expect one path")
+		}
+		count[picked[0]]++
+	}
+	for _, v := range paths {
+		if count[v] != 10 {
+			t.Fatal("expect packets striped evenly", count[v])
+		}
+	}
+}
+
+func TestMinRTTScheduler(t *testing.T) {
+	paths := testPaths()
+	paths[0], paths[2] = paths[2], paths[0]
+	picked := NewMinRTTScheduler().Pick(PacketInfo{}, paths)
+	if len(picked) != 1 || picked[0].RTT() != 10*time.Millisecond {
+		t.Fatal("expect path of min rtt")
+	}
+}
+
+func TestWeightedRandomScheduler(t *testing.T) {
+	paths := testPaths()
+	s := NewWeightedRandomScheduler()
+	count := make(map[Path]int)
+	for i := 0; i < 10000; i++ {
+		count[s.Pick(PacketInfo{}, paths)[0]]++
+	}
+	// weight 1 to 4 out of 10
+	for i, v := range paths {
+		expect := 1000 * (i + 1)
+		if count[v] < expect*8/10 || count[v] > expect*12/10 {
+			t.Fatal("expect packets in proportion to weight", i, count[v])
+		}
+	}
+}
+
+func TestRedundantNScheduler(t *testing.T) {
+	paths := testPaths()
+	picked := NewRedundantNScheduler(3).Pick(PacketInfo{}, paths)
+	if len(picked) != 3 || picked[0] != paths[0] || picked[1] != paths[1] || picked[2] != paths[2] {
+		t.Fatal("expect the best 3 paths")
+	}
+	if picked[0].Group() == picked[1].Group() {
+		t.Fatal("expect first 2 copies in different groups")
+	}
+
+	if picked := NewRedundantNScheduler(8).Pick(PacketInfo{}, paths); len(picked) != len(paths) {
+		t.Fatal("expect every path", len(picked))
+	}
+}
+
+func TestBondingScheduler(t *testing.T) {
+	paths := testPaths()
+	for i, v := range paths {
+		v.(*upstream).bw = int64(i * 1000000)
+	}
+	s := NewBondingScheduler()
+	count := make(map[Path]int)
+	for i := 0; i < 10000; i++ {
+		picked := s.Pick(PacketInfo{}, paths)
+		if len(picked) != 1 {
+			t.Fatal("expect data packet sent once")
+		}
+		count[picked[0]]++
+	}
+	// 0, 1, 2, 3MB/s plus 0.15MB/s floor each, out of 6.6MB/s
+	for i, v := range paths {
+		expect := 10000 * (i*100 + 15) / 660
+		if count[v] < expect*7/10 || count[v] > expect*13/10 {
+			t.Fatal("expect packets in proportion to bandwidth", i, count[v], expect)
+		}
+	}
+
+	if picked := s.Pick(PacketInfo{Control: true}, paths); len(picked) != 2 {
+		t.Fatal("expect control packet sent redundantly")
+	}
+}
@@ -0,0 +1,203 @@
+package trafcacc
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+var errUpstreamClosed = errors.New("upstream is closed")
+
+// sendq of upstream is drained by its writer, so that packets are never
+// encoded on the same conn concurrently. Control packets are written before
+// data. The writer is started with the conn of upstream and waits for
+// packets until the upstream is closed.
+//
+// When the queue is full, a new data packet waits up to sendtimeout for
+// room if it's sent by writer of the connection, so that slow upstream
+// slows the writer. Otherwise, eg. retransmit, it's dropped and recovered
+// by retransmit like it's lost on the wire. A control packet takes the
+// place of the oldest one.
+type sendq struct {
+	ctrl    chan sendreq
+	data    chan sendreq
+	dropped uint64
+
+	// packets taken by the writer to write in a batch
+	batch []sendreq
+}
+
+// sendreq is a packet queued and the pool it's written for, send errors of
+// it are recorded in breaker if pool is not nil
+type sendreq struct {
+	p    *packet
+	pool *streampool
+}
+
+func newSendq() sendq {
+	return sendq{
+		ctrl: make(chan sendreq, sendqctrl),
+		data: make(chan sendreq, sendqdata),
+	}
+}
+
+// enqueue p to be written on u by the writer, data packet waits for room if
+// wait is true
+func (u *upstream) enqueue(p *packet, pool *streampool, wait bool) error {
+	if atomic.LoadInt32(&u.closed) != 0 {
+		return errUpstreamClosed
+	}
+
+	q := &u.sendq
+	r := sendreq{p: p, pool: pool}
+	// held until it's written
+	p.hold()
+	if p.Cmd == data {
+		select {
+		case q.data <- r:
+		default:
+			if !wait {
+				q.drop(p)
+				break
+			}
+			select {
+			case q.data <- r:
+			case <-time.After(sendtimeout):
+				q.drop(p)
+			}
+		}
+	} else {
+		for queued := false; !queued; {
+			select {
+			case q.ctrl <- r:
+				queued = true
+			default:
+				select {
+				case old := <-q.ctrl:
+					q.drop(old.p)
+				default:
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// writeloop write queued packets until ctx is done, udp packets are taken
+// up to udpbatch at a time
+func (u *upstream) writeloop(ctx context.Context) {
+	defer u.writers.Done()
+	q := &u.sendq
+	max := 1
+	if u.proto == udp {
+		max = udpbatch
+	}
+	for ctx.Err() == nil {
+		if rs := q.take(max); len(rs) > 0 {
+			u.write(rs)
+			continue
+		}
+		select {
+		case r := <-q.ctrl:
+			u.write(append(q.batch[:0], r))
+		case r := <-q.data:
+			u.write(append(q.batch[:0], r))
+		case <-ctx.Done():
+		}
+	}
+}
+
+// next returns the next packet to write, control first
+func (q *sendq) next() (sendreq, bool) {
+	select {
+	case r := <-q.ctrl:
+		return r, true
+	default:
+	}
+	select {
+	case r := <-q.ctrl:
+		return r, true
+	case r := <-q.data:
+		return r, true
+	default:
+		return sendreq{}, false
+	}
+}
+
+// drop p that is not written
+func (q *sendq) drop(p *packet) {
+	atomic.AddUint64(&q.dropped, 1)
+	p.release()
+}
+
+// take up to max packets queued, control first
+func (q *sendq) take(max int) []sendreq {
+	q.batch = q.batch[:0]
+	for len(q.batch) < max {
+		r, ok := q.next()
+		if !ok {
+			break
+		}
+		q.batch = append(q.batch, r)
+	}
+	return q.batch
+}
+
+func (q *sendq) len() int {
+	return len(q.ctrl) + len(q.data)
+}
+
+// write rs on u, udp packets are written in batches, a batch is written
+// before a data packet waits for its turn
+func (u *upstream) write(rs []sendreq) {
+	if u.proto != udp {
+		for _, r := range rs {
+			u.written(r, u.sendpacket(r.p))
+		}
+		return
+	}
+
+	start := 0
+	for i, r := range rs {
+		if i > start && r.p.Cmd == data && u.cc.delay() > 0 {
+			u.writebatch(rs[start:i])
+			start = i
+		}
+		// control packets are not delayed, but take their share of rate
+		u.cc.pace(len(r.p.Buf), r.p.Cmd == data)
+	}
+	u.writebatch(rs[start:])
+}
+
+func (u *upstream) writebatch(rs []sendreq) {
+	n, err := u.sendbatch(rs)
+	for i, r := range rs {
+		if i < n {
+			u.written(r, nil)
+		} else {
+			u.written(r, err)
+		}
+	}
+}
+
+// written records the result of r in breaker of u, paths are updated at
+// once if the breaker is tripped or closed. The packet is released.
+func (u *upstream) written(r sendreq, err error) {
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Warnln("encode packet to upstream errror")
+		// gob stream is broken after error, udp socket is kept
+		if u.proto == tcp {
+			u.close()
+		}
+	}
+	r.p.release()
+	if r.pool != nil && u.brk.record(u, err) {
+		r.pool.updatealive()
+	}
+}
@@ -1,10 +1,10 @@
 package trafcacc
 
 import (
-	"encoding/gob"
+	"errors"
 	"net"
-	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -16,6 +16,10 @@ type serve struct {
 
 	alive   bool
 	handler Handler
+
+	// listened servs by proto://host:port, guarded by smux
+	smux  sync.Mutex
+	servs map[string]*serv
 }
 
 // HandlerFunc TODO: comment
@@ -32,26 +36,64 @@ func NewServe() Serve {
 }
 
 func newServe() *serve {
+	n := newNode("server")
+	n.peers = make(map[uint32]*streampool)
 	return &serve{
-		Cond: sync.NewCond(&sync.Mutex{}),
-		node: newNode("server"),
+		Cond:  sync.NewCond(&sync.Mutex{}),
+		node:  n,
+		servs: make(map[string]*serv),
 	}
 }
 
 // HandleFunc registers the handler for the given addresses
 // that back-end server listened to
-func (mux *serve) HandleFunc(listento string, handler func(net.Conn)) {
-	mux.Handle(listento, handlerFunc(handler))
+func (mux *serve) HandleFunc(listento string, handler func(net.Conn)) error {
+	return mux.Handle(listento, handlerFunc(handler))
 }
 
 // Handle registers the handler for the given addresses
-func (mux *serve) Handle(listento string, handler Handler) {
+func (mux *serve) Handle(listento string, handler Handler) error {
 	// TODO: handle as backend
 	mux.handler = handler
-	for _, e := range parse(listento) {
-		for p := e.portBegin; p <= e.portEnd; p++ {
-			s := serv{serve: mux, proto: e.proto, addr: net.JoinHostPort(e.host, strconv.Itoa(p))}
-			s.listen()
+	return mux.Reload(listento)
+}
+
+// Reload the addresses that back-end server listened to. New addresses are
+// listened, the ones no longer listed are closed and their tunnels drained.
+// Established connections are kept. The first bind error is returned after
+// the rest of listento has been applied.
+func (mux *serve) Reload(listento string) (err error) {
+	endpoints, err := ParseEndpoints(listento)
+	if err != nil {
+		return err
+	}
+
+	mux.smux.Lock()
+	defer mux.smux.Unlock()
+
+	listed := make(map[string]bool)
+	for _, e := range endpoints {
+		for _, addr := range e.Addrs() {
+			key := e.Proto + "://" + addr
+			listed[key] = true
+			if _, exist := mux.servs[key]; exist {
+				continue
+			}
+			s := &serv{
+				serve:     mux,
+				proto:     e.Proto,
+				addr:      addr,
+				upstreams: make(map[*upstream]struct{}),
+				udpups:    make(map[string]*upstream),
+			}
+			if lerr := s.listen(); lerr != nil {
+				logrus.WithError(lerr).Errorln("server listen error")
+				if err == nil {
+					err = lerr
+				}
+				continue
+			}
+			mux.servs[key] = s
 			go func() {
 				s.waitforalive()
 				mux.L.Lock()
@@ -61,6 +103,51 @@ func (mux *serve) Handle(listento string, handler Handler) {
 			}()
 		}
 	}
+
+	for key, s := range mux.servs {
+		if !listed[key] {
+			delete(mux.servs, key)
+			logrus.WithField("listen", key).Infoln("server stop listen")
+			s.close()
+		}
+	}
+	return err
+}
+
+// Close stops mux, listeners and their upstreams are closed at once
+// without draining
+func (mux *serve) Close() error {
+	mux.stop()
+
+	mux.smux.Lock()
+	defer mux.smux.Unlock()
+	for key, s := range mux.servs {
+		delete(mux.servs, key)
+		s.shutdown()
+	}
+	return nil
+}
+
+// upool returns the pool that u is in, or the pool of upstreams whose peer
+// is unknown if u has left
+func (mux *serve) upool(u *upstream) *streampool {
+	if pool := mux.poolof(atomic.LoadUint32(&u.peer)); pool != nil {
+		return pool
+	}
+	return mux.pool
+}
+
+// setpeer move u into the pool of peer when the peer is learned from the
+// first ping, so that packets to a peer are only sent on its own upstreams
+func (mux *serve) setpeer(u *upstream, peer uint32) {
+	if peer == 0 || atomic.LoadUint32(&u.peer) != 0 {
+		return
+	}
+	mux.join(u, peer)
+	logrus.WithFields(logrus.Fields{
+		"peer":  peer,
+		"proto": u.proto,
+	}).Debugln("server upstream of peer")
 }
 
 func (mux *serve) waitforalive() {
@@ -73,9 +160,20 @@ func (mux *serve) waitforalive() {
 
 type serv struct {
 	*serve
-	proto string
-	addr  string
-	alive bool
+	proto   string
+	addr    string
+	alive   bool
+	retired int32
+
+	ln       net.Listener
+	udpconn  *net.UDPConn
+	udpbatch batchconn
+
+	// upstreams accepted from this address, and udp ones by remote address,
+	// guarded by umux
+	umux      sync.Mutex
+	upstreams map[*upstream]struct{}
+	udpups    map[string]*upstream
 }
 
 func (s *serv) waitforalive() {
@@ -93,14 +191,15 @@ func (s *serv) setalive() {
 	s.Broadcast()
 }
 
-func (s *serv) listen() {
+func (s *serv) listen() error {
 	switch s.proto {
 	case tcp:
 		ln, err := net.Listen("tcp", s.addr)
 		if err != nil {
-			logrus.Fatalln("net.Listen error", s.addr, err)
+			return &BindError{Proto: s.proto, Addr: s.addr, Err: err}
 		}
 
+		s.ln = ln
 		s.setalive()
 
 		if logrus.GetLevel() >= logrus.DebugLevel {
@@ -110,77 +209,234 @@ func (s *serv) listen() {
 	case udp:
 		udpaddr, err := net.ResolveUDPAddr("udp", s.addr)
 		if err != nil {
-			logrus.Fatalln("net.ResolveUDPAddr error", s.addr, err)
+			return &BindError{Proto: s.proto, Addr: s.addr, Err: err}
 		}
 		udpconn, err := net.ListenUDP("udp", udpaddr)
 		if err != nil {
-			logrus.Fatalln("net.ListenUDP error", udpaddr, err)
+			return &BindError{Proto: s.proto, Addr: s.addr, Err: err}
 		}
 
+		s.udpconn = udpconn
+		s.udpbatch = newBatchConn(udpconn)
 		s.setalive()
 
-		go func() {
-			for {
-				s.udphandler(udpconn)
-			}
-		}()
+		go s.udphandler()
+		go s.expireloop()
 	}
+	return nil
 }
 
-func (s *serv) udphandler(conn *net.UDPConn) {
-	u := newUpstream(s.proto)
-	u.udpconn = conn
+// close stop accepting new tunnels and drain the ones already accepted,
+// udp socket is closed once its upstreams are drained
+func (s *serv) close() {
+	atomic.StoreInt32(&s.retired, 1)
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	if s.udpconn != nil {
+		time.AfterFunc(draintime, func() {
+			s.udpconn.Close()
+		})
+	}
 
-	// add to pool
-	s.pool.append(u, 0)
-	defer func() {
+	s.umux.Lock()
+	for u := range s.upstreams {
+		go func(u *upstream) {
+			s.upool(u).drain(u)
+			s.leave(u)
+		}(u)
+	}
+	s.umux.Unlock()
+}
+
+// shutdown closes s and its upstreams at once
+func (s *serv) shutdown() {
+	atomic.StoreInt32(&s.retired, 1)
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	if s.udpconn != nil {
+		s.udpconn.Close()
+	}
+
+	s.umux.Lock()
+	for u := range s.upstreams {
+		atomic.StoreInt32(&u.retired, 1)
 		u.close()
-		s.pool.remove(u)
+		s.leave(u)
+	}
+	s.umux.Unlock()
+}
+
+func (s *serv) track(u *upstream) {
+	s.umux.Lock()
+	s.upstreams[u] = struct{}{}
+	s.umux.Unlock()
+}
+
+func (s *serv) untrack(u *upstream) {
+	s.umux.Lock()
+	delete(s.upstreams, u)
+	s.umux.Unlock()
+}
+
+// udphandler demultiplex packets of the udp listener into upstreams by
+// remote address
+func (s *serv) udphandler() {
+	defer func() {
+		s.umux.Lock()
+		for key, u := range s.udpups {
+			s.expire(key, u)
+		}
+		s.umux.Unlock()
 	}()
 
+	r := newBatchReader(s.udpbatch)
+	defer r.close()
 	for {
-		udpbuf := make([]byte, buffersize)
-		n, addr, err := conn.ReadFromUDP(udpbuf)
+		err := r.read(func(p *packet, addr *net.UDPAddr) {
+			u := s.udpupstream(addr)
+			atomic.StoreInt64(&u.seen, time.Now().UnixNano())
+
+			n := len(p.Buf)
+			if err := decodePacket(p.Buf, p); err != nil {
+				p.release()
+				logrus.WithError(err).Warnln("server gop decode from udp error", n)
+				return
+			}
+			if p.Cmd == ping {
+				u = s.follow(u, p, addr)
+			}
+
+			p.udp = true
+			if err := s.proc(u, p); err != nil {
+				logrus.WithError(err).Warn("serve send pong err")
+			}
+		})
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			logrus.WithError(err).Warnln("ReadFromUDP error")
-			break
-		}
-		if u.udpaddr == nil {
-			u.udpaddr = addr
 		}
+	}
+}
 
-		p := packet{}
-		if err := decodePacket(udpbuf[:n], &p); err != nil {
-			logrus.WithError(err).Warnln("server gop decode from udp error", n)
+// udpupstream returns the upstream of remote addr, a new one is added to the
+// pool if there is none
+func (s *serv) udpupstream(addr *net.UDPAddr) *upstream {
+	key := addr.String()
+
+	s.umux.Lock()
+	defer s.umux.Unlock()
+	u, exist := s.udpups[key]
+	if !exist {
+		u = newUpstream(s.proto)
+		u.udpconn = s.udpconn
+		u.batch = s.udpbatch
+		u.udpaddr.Store(addr)
+		atomic.StoreInt64(&u.seen, time.Now().UnixNano())
+		u.start(nil)
+		s.udpups[key] = u
+		s.upstreams[u] = struct{}{}
+		s.pool.append(u, 0)
+	}
+	return u
+}
+
+// follow the path of ping to addr if the sender and path token of it match
+// an upstream from another address, eg. after NAT rebinding. The ping must
+// be signed with the key shared by peers and newer than any received on
+// that upstream, so that neither a forged nor a replayed ping takes over the
+// path. Without key, the address change is not followed and the upstream of
+// the old address expires. Returns the upstream of the path.
+func (s *serv) follow(u *upstream, p *packet, addr *net.UDPAddr) *upstream {
+	pb := probe{}
+	if decodeProbe(p.Buf, &pb) != nil || pb.Token == 0 || p.Senderid == 0 {
+		return u
+	}
+	signed := pb.signed(s.signkey(), p.Senderid)
+
+	s.umux.Lock()
+	defer s.umux.Unlock()
+	if u.token == pb.Token {
+		return u
+	}
+	for key, old := range s.udpups {
+		if old == u || old.token != pb.Token || atomic.LoadUint32(&old.peer) != p.Senderid {
 			continue
 		}
+		if !signed || pb.Seq <= atomic.LoadUint64(&old.probetop) {
+			logrus.WithFields(logrus.Fields{
+				"from":   key,
+				"to":     addr.String(),
+				"seq":    pb.Seq,
+				"signed": signed,
+			}).Warnln("server ignore ping of the path from another address")
+			break
+		}
+		s.expire(addr.String(), u)
+		delete(s.udpups, key)
+		s.udpups[addr.String()] = old
+		old.udpaddr.Store(addr)
+		atomic.StoreInt64(&old.seen, atomic.LoadInt64(&u.seen))
+		logrus.WithFields(logrus.Fields{
+			"from": key,
+			"to":   addr.String(),
+		}).Infoln("server udp upstream address changed")
+		return old
+	}
+	u.token = pb.Token
+	return u
+}
 
-		p.udp = true
-		if err := s.proc(u, &p); err != nil {
-			logrus.WithError(err).Warn("serve send pong err")
+// expireloop remove udp upstreams that received nothing in udpidle
+func (s *serv) expireloop() {
+	tick := time.NewTicker(udpidle / 4)
+	defer tick.Stop()
+	for range tick.C {
+		if atomic.LoadInt32(&s.retired) != 0 {
 			return
 		}
+		now := time.Now().UnixNano()
+		s.umux.Lock()
+		for key, u := range s.udpups {
+			if time.Duration(now-atomic.LoadInt64(&u.seen)) > udpidle {
+				logrus.WithField("addr", key).Debugln("server udp upstream expired")
+				s.expire(key, u)
+			}
+		}
+		s.umux.Unlock()
 	}
 }
 
+// expire remove udp upstream u of key, umux must be held
+func (s *serv) expire(key string, u *upstream) {
+	delete(s.udpups, key)
+	delete(s.upstreams, u)
+	u.close()
+	s.leave(u)
+}
+
 // handle packed data from client side as backend
 func (s *serv) tcphandler(conn net.Conn) {
-
-	dec := gob.NewDecoder(conn)
-	enc := gob.NewEncoder(conn)
-
 	// add to pool
 	u := newUpstream(s.proto)
-	u.encoder = enc
-	u.decoder = dec
+	if !u.start(conn) {
+		conn.Close()
+		return
+	}
+	dec := u.decoder
 
 	defer func() {
-		conn.Close()
+		s.untrack(u)
+		u.close()
 		// remove from pool
-		s.pool.remove(u)
+		s.leave(u)
 	}()
 
 	s.pool.append(u, 0)
+	s.track(u)
 
 	for {
 		p := packet{}
@@ -197,12 +453,27 @@ func (s *serv) tcphandler(conn net.Conn) {
 	}
 }
 
+// proc p received from u, data is handed over to push and the rest is
+// released
 func (s *serv) proc(u *upstream, p *packet) error {
-	s.node.proc(u, p)
+	if p.Cmd == ping {
+		s.setpeer(u, p.Senderid)
+	}
+	pb := s.node.proc(u, p)
+	if p.Cmd != data {
+		defer p.release()
+	}
 	switch p.Cmd {
 	case ping:
+		u.probed(true)
+		if pb != nil {
+			if int(pb.Grp) != u.grp {
+				s.upool(u).setgroup(u, int(pb.Grp))
+			}
+			s.upool(u).followudp(pb.Flags&probeUDPBlocked != 0)
+		}
 		// reply
-		err := u.send(pong)
+		err := u.sendprobe(pong, 0, 0, nil)
 		if err != nil {
 			return err
 		}
@@ -14,6 +14,109 @@ const (
 	mtu        = buffersize - 100
 	keepalive  = time.Second * 30
 	rqudelay   = time.Millisecond * 300
+	draintime  = time.Second * 5
+	udpidle    = keepalive // udp upstream of server expires after udpidle
+
+	// upstream hostnames are resolved again after resolvettl
+	resolvettl     = time.Second * 30
+	resolvetimeout = time.Second * 5
+
+	// upstream reconnect backoff, reset once connection lasted stableconn
+	backoffmin    = time.Millisecond * 500
+	backoffmax    = time.Minute
+	stableconn    = keepalive
+	downlogperiod = time.Second * 10
+
+	// upstream loss is sampled every losswindow probes, score of upstream
+	// is srtt*(1+lossfactor*loss)
+	losswindow = 5
+	lossfactor = 10
+
+	// packets are sent in 1 copy if loss of every path is below lossclean
+	// for copieshold, in 3 copies if loss of any path is above lossspike,
+	// in 2 copies otherwise
+	lossclean  = 0.005
+	lossspike  = 0.05
+	copieshold = time.Second * 10
+
+	// upstream is marked failed after detectmult probes in a row are missed
+	// at pinginterval, and recovers after holddown probes in a row received.
+	// holddown doubles from holddownmin up to holddownmax when it fails again
+	// within flapwindow after recovery.
+	pinginterval = time.Second
+	detectmult   = 3
+	holddownmin  = 3
+	holddownmax  = 60
+	flapwindow   = time.Minute
+
+	// upstream breaker is tripped open by breakerfails send errors in a row
+	// or loss above breakerloss, it's half-open after breakermin doubled
+	// up to breakermax, and closed after breakertrials trial copies sent at
+	// most one per breakertrialinterval. tcp send times out in sendtimeout.
+	breakerfails         = 3
+	breakerloss          = 0.3
+	breakermin           = time.Second * 2
+	breakermax           = time.Minute
+	breakertrials        = 5
+	breakertrialinterval = time.Millisecond * 200
+	sendtimeout          = time.Second * 5
+
+	// udp is blocked when less than udpdelivery of udp data sent in the
+	// last udpwindow bytes is received by peer, and re-probed after
+	// udpreprobe
+	udpwindow   = 256 * 1024
+	udpdelivery = 0.7
+	udpreprobe  = time.Second * 30
+
+	// upstreams a packet is sent on are remembered up to maxsentby
+	maxsentby = 8
+
+	// upstream bandwidth is the max delivery rate of last bwwindow probes
+	bwwindow = 10
+
+	// bonding scheduler gives every path 1/bondprobe of the mean bandwidth
+	bondprobe = 10
+
+	// received packets are acked at most every ackinterval, the last ack
+	// is repeated every ackrepeat. Unacked packets sent are cached up to
+	// cacheconn bytes per connection and cacheall bytes in total. Receiver
+	// buffers up to recvwindow packets not read yet per connection.
+	ackinterval = time.Millisecond * 100
+	ackrepeat   = time.Second
+	cacheconn   = 8 * 1024 * 1024
+	cacheall    = 64 * 1024 * 1024
+	recvwindow  = 1024
+
+	// packets not acked in rto are sent again, up to rtoburst per
+	// connection every rqudelay
+	rto      = rqudelay * 2
+	rtoburst = 16
+
+	// udp upstream is paced from ccinitrate, the rate is cut to ccbeta%
+	// on loss or rtt ccdelay above the minimum of ccminrttwindow, it's
+	// doubled up to ssthresh then grows by ccstep. rate is kept in
+	// [ccminrate, ccmaxrate], sends burst up to ccburst after idle.
+	ccinitrate     = 8 * 1024 * 1024
+	ccminrate      = 64 * 1024
+	ccmaxrate      = 1024 * 1024 * 1024
+	ccstep         = 512 * 1024
+	ccbeta         = 70
+	ccdelay        = time.Millisecond * 50
+	ccminrttwindow = time.Second * 10
+	ccburst        = time.Millisecond * 2
+
+	// packets of connection are held in ring of ringsize at first, and
+	// connections are looked up in connshards shards
+	ringsize   = 64
+	connshards = 16
+
+	// send queue of upstream holds up to sendqdata data packets and
+	// sendqctrl control packets
+	sendqdata = 256
+	sendqctrl = 64
+
+	// udp packets are read and written up to udpbatch in one syscall
+	udpbatch = 32
 )
 
 const (
@@ -23,9 +126,13 @@ const (
 
 // Dialer TODO: comment
 type Dialer interface {
-	Setup(string)
+	Setup(string) error
+	Reload(string) error
 	Dial() (net.Conn, error)
 	DialTimeout(timeout time.Duration) (net.Conn, error)
+	SetScheduler(Scheduler)
+	SetKey([]byte)
+	Close() error
 	streampool() *streampool
 }
 
@@ -41,6 +148,46 @@ type Handler interface {
 
 // Serve TODO: comment
 type Serve interface {
-	HandleFunc(listento string, handler func(net.Conn))
-	Handle(listento string, handler Handler)
+	HandleFunc(listento string, handler func(net.Conn)) error
+	Handle(listento string, handler Handler) error
+	Reload(listento string) error
+	SetScheduler(Scheduler)
+	SetKey([]byte)
+	Close() error
+}
+
+// ParseError is returned when an endpoint argument can not be parsed
+type ParseError struct {
+	Arg string
+	Msg string
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	s := "trafcacc: " + e.Msg + " " + e.Arg
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+// Unwrap returns the underlying error
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// BindError is returned when listen to an address failed
+type BindError struct {
+	Proto string
+	Addr  string
+	Err   error
+}
+
+func (e *BindError) Error() string {
+	return "trafcacc: bind " + e.Proto + "://" + e.Addr + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *BindError) Unwrap() error {
+	return e.Err
 }
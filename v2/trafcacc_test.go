@@ -2,12 +2,14 @@ package trafcacc
 
 import (
 	"encoding/gob"
+	"errors"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	//_ "net/http/pprof"
 	"os"
 	"os/exec"
@@ -74,10 +76,14 @@ func TestDialUDP(t *testing.T) {
 
 func testDial(f, s string, t *testing.T) {
 	srv := NewServe()
-	srv.HandleFunc(s, testDialServe0)
+	if err := srv.HandleFunc(s, testDialServe0); err != nil {
+		t.Fatal("serve handle error", err)
+	}
 
 	d := NewDialer()
-	d.Setup(f)
+	if err := d.Setup(f); err != nil {
+		t.Fatal("dialer setup error", err)
+	}
 
 	conn, err := d.Dial()
 	if err != nil {
@@ -125,6 +131,273 @@ func testDial(f, s string, t *testing.T) {
 	conn.Close()
 }
 
+func TestReload(t *testing.T) {
+	srv := NewServe()
+	if err := srv.HandleFunc("udp://:55010-55015", testDialServe0); err != nil {
+		t.Fatal("serve handle error", err)
+	}
+
+	d := NewDialer()
+	if err := d.Setup("udp://127.0.0.1:55010-55012"); err != nil {
+		t.Fatal("dialer setup error", err)
+	}
+
+	conn, err := d.Dial()
+	if err != nil {
+		t.Fatal("dialer dial error", err)
+	}
+	defer conn.Close()
+
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+
+	in := test{N: 1}
+	for i := 0; i < 20; i++ {
+		if i == 10 {
+			// move to the other half of the ports while conn is open
+			if err := d.Reload("udp://127.0.0.1:55013-55015"); err != nil {
+				t.Fatal("dialer reload error", err)
+			}
+			if err := srv.Reload("udp://:55013-55015"); err != nil {
+				t.Fatal("serve reload error", err)
+			}
+		}
+		in.Buf = randomBytes(buffersize)
+		if err := enc.Encode(in); err != nil {
+			t.Fatal("dialer write error", err)
+		}
+		out := test{}
+		if err := dec.Decode(&out); err != nil {
+			t.Fatal("dialer read error", err)
+		}
+		if out.N != in.N+1 || len(out.Buf) != len(in.Buf) {
+			t.Fatal("unexpected echo", out.N, in.N)
+		}
+		in.N = out.N + 1
+	}
+}
+
+func TestAccelerateRollback(t *testing.T) {
+	busy, err := net.Listen("tcp", ":55041")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	// listeners bound before the bind error are closed
+	if _, err := Accelerate("tcp://127.0.0.1:55040,tcp://:55041", "tcp://127.0.0.1:55042", FRONTEND); err == nil {
+		t.Fatal("expect bind error of frontend")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:55040")
+	if err != nil {
+		t.Fatal("expect frontend listener closed", err)
+	}
+	ln.Close()
+
+	if _, err := Accelerate("tcp://:55043,udp://:55043,tcp://:55041", "tcp://127.0.0.1:55042", BACKEND); err == nil {
+		t.Fatal("expect bind error of backend")
+	}
+	ln, err = net.Listen("tcp", ":55043")
+	if err != nil {
+		t.Fatal("expect backend tcp listener closed", err)
+	}
+	ln.Close()
+	pc, err := net.ListenPacket("udp", ":55043")
+	if err != nil {
+		t.Fatal("expect backend udp listener closed", err)
+	}
+	pc.Close()
+}
+
+func TestFrontendListenPorts(t *testing.T) {
+	tc, err := Accelerate("tcp://127.0.0.1:55044-55045+55047", "tcp://127.0.0.1:55042", FRONTEND)
+	if err != nil {
+		t.Fatal("accelerate error", err)
+	}
+	for _, port := range []string{"55044", "55045", "55047"} {
+		if ln, err := net.Listen("tcp", "127.0.0.1:"+port); err == nil {
+			ln.Close()
+			t.Fatal("expect frontend listen to port", port)
+		}
+	}
+	tc.Close()
+}
+
+func TestMultiplePeers(t *testing.T) {
+	srv := newServe()
+	if err := srv.HandleFunc("tcp://:55020-55023", testDialServe0); err != nil {
+		t.Fatal("serve handle error", err)
+	}
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		d := NewDialer()
+		if err := d.Setup("tcp://127.0.0.1:55020-55023"); err != nil {
+			t.Fatal("dialer setup error", err)
+		}
+		go func() {
+			conn, err := d.Dial()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+
+			enc := gob.NewEncoder(conn)
+			dec := gob.NewDecoder(conn)
+			in := test{N: 1}
+			for j := 0; j < 10; j++ {
+				in.Buf = randomBytes(buffersize)
+				if err := enc.Encode(in); err != nil {
+					errs <- err
+					return
+				}
+				out := test{}
+				if err := dec.Decode(&out); err != nil {
+					errs <- err
+					return
+				}
+				if out.N != in.N+1 || len(out.Buf) != len(in.Buf) {
+					errs <- errors.New("unexpected echo")
+					return
+				}
+				in.N = out.N + 1
+			}
+			errs <- nil
+		}()
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatal("peer echo error", err)
+			}
+		case <-time.After(time.Second * 10):
+			t.Fatal("peer echo timeout")
+		}
+	}
+
+	// upstreams of each frontend are in a pool of their own once they
+	// pinged
+	peers := func() (n int) {
+		for _, pool := range srv.pools() {
+			pool.RLock()
+			if pool.peer != 0 && len(pool.pool) == 4 {
+				n++
+			}
+			pool.RUnlock()
+		}
+		return
+	}
+	for i := 0; peers() != 2; i++ {
+		if i > 30 {
+			t.Fatal("expect 2 peers of 4 upstreams, got", peers())
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	if len(srv.pools()) != 3 {
+		t.Fatal("expect pools of 2 peers, got", len(srv.pools())-1)
+	}
+}
+
+func TestUDPRebind(t *testing.T) {
+	key := []byte("shared key")
+	srv := newServe()
+	srv.SetKey(key)
+	if err := srv.HandleFunc("udp://:55030", testDialServe0); err != nil {
+		t.Fatal("serve handle error", err)
+	}
+	var s *serv
+	for _, v := range srv.servs {
+		s = v
+	}
+
+	// the only udp upstream of s, once it's from addr
+	lookup := func(addr net.Addr) *upstream {
+		for i := 0; i < 30; i++ {
+			s.umux.Lock()
+			u, exist := s.udpups[addr.String()]
+			n := len(s.udpups)
+			s.umux.Unlock()
+			if exist && n == 1 && atomic.LoadUint32(&u.peer) != 0 {
+				return u
+			}
+			time.Sleep(time.Millisecond * 100)
+		}
+		t.Fatal("expect one udp upstream from", addr)
+		return nil
+	}
+
+	// same path pings from a new source port, as NAT rebinding does
+	u := newUpstream(udp)
+	u.token = 0x5eed
+	defer u.close()
+	var first *upstream
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("udp", "127.0.0.1:55030")
+		if err != nil {
+			t.Fatal("dial error", err)
+		}
+		defer conn.Close()
+		u.close()
+		u.start(conn)
+		if err := u.sendprobe(ping, 0x1234, 0, key); err != nil {
+			t.Fatal("send ping error", err)
+		}
+		got := lookup(conn.LocalAddr())
+		if first == nil {
+			first = got
+		} else if got != first {
+			t.Fatal("upstream of the path is not followed")
+		}
+
+		// pong is sent to the new address
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, buffersize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal("read pong error", err)
+		}
+		p := packet{}
+		if err := decodePacket(buf[:n], &p); err != nil || p.Cmd != pong {
+			t.Fatal("expect pong", p.Cmd, err)
+		}
+	}
+
+	// a ping replayed or forged from another address doesn't take over
+	// the path
+	followed := first.udpaddr.Load().(*net.UDPAddr).String()
+	for _, c := range []struct {
+		name string
+		seq  uint64 // probeseq of u before the ping
+		key  []byte
+	}{
+		{"replayed", 0, key},
+		{"unsigned", 100, nil},
+		{"forged", 200, []byte("other key")},
+	} {
+		conn, err := net.Dial("udp", "127.0.0.1:55030")
+		if err != nil {
+			t.Fatal("dial error", err)
+		}
+		defer conn.Close()
+		atomic.StoreUint64(&u.probeseq, c.seq)
+		u.close()
+		u.start(conn)
+		if err := u.sendprobe(ping, 0x1234, 0, c.key); err != nil {
+			t.Fatal("send ping error", err)
+		}
+		time.Sleep(time.Millisecond * 200)
+		s.umux.Lock()
+		other := s.udpups[conn.LocalAddr().String()]
+		s.umux.Unlock()
+		if other == nil || other == first || first.udpaddr.Load().(*net.UDPAddr).String() != followed {
+			t.Fatal("expect", c.name, "ping not followed")
+		}
+	}
+}
+
 func randomBytes(n int) []byte {
 
 	b := make([]byte, n)
@@ -136,6 +409,41 @@ func randomBytes(n int) []byte {
 	return b
 }
 
+func TestPeerPoolLifetime(t *testing.T) {
+	srv := newServe()
+	defer srv.Close()
+	if err := srv.HandleFunc("udp://127.0.0.1:55051", testDialServe0); err != nil {
+		t.Fatal("serve handle error", err)
+	}
+	var s *serv
+	for _, v := range srv.servs {
+		s = v
+	}
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 55052}
+	u := s.udpupstream(addr)
+
+	// only ping makes a pool of the peer
+	s.proc(u, &packet{Senderid: 0x1234, Cmd: ack})
+	if len(srv.pools()) != 1 {
+		t.Fatal("expect no pool of peer before ping", len(srv.pools()))
+	}
+	pb := newUpstream(udp).newprobe(time.Now().UnixNano())
+	s.proc(u, &packet{Senderid: 0x1234, Cmd: ping, Buf: pb.encode()})
+	pool := srv.poolof(0x1234)
+	if pool == nil || len(srv.pools()) != 2 {
+		t.Fatal("expect a pool of peer after ping", len(srv.pools()))
+	}
+
+	// the pool is gone with its last upstream
+	s.umux.Lock()
+	s.expire(addr.String(), u)
+	s.umux.Unlock()
+	if srv.poolof(0x1234) != nil || len(srv.pools()) != 1 || pool.ctx.Err() == nil {
+		t.Fatal("expect pool of peer removed and stopped")
+	}
+}
+
 func TestHTTPviaTCP(t *testing.T) {
 	testHTTP("tcp://:41601-41604", "tcp://127.0.0.1:41601-41604", "50581", t)
 }
@@ -146,10 +454,16 @@ func TestHTTPviaUDP(t *testing.T) {
 
 func testHTTP(bc, fc, lport string, t *testing.T) {
 
-	t0 := Accelerate(bc, "tcp://bing.com:80", BACKEND)
+	t0, err := Accelerate(bc, "tcp://bing.com:80", BACKEND)
+	if err != nil {
+		t.Fatal(err)
+	}
 	t0.WaitforAlive()
 
-	t1 := Accelerate("tcp://:"+lport, fc, FRONTEND)
+	t1, err := Accelerate("tcp://:"+lport, fc, FRONTEND)
+	if err != nil {
+		t.Fatal(err)
+	}
 	t1.WaitforAlive()
 
 	client := &http.Client{}
@@ -184,7 +498,7 @@ func BenchmarkPacketQueueAdd(b *testing.B) {
 			uint32(1), uint32(i),
 			nil, data, false,
 			time.Now().UnixNano(),
-			sync.RWMutex{},
+			sync.RWMutex{}, nil, 0, nil, 0,
 		}
 		pqs.add(p)
 		pqs.add(p)
@@ -208,9 +522,15 @@ func TestIPERF(t *testing.T) {
 		pid := cmd0.Process.Pid
 		go cmd0.Wait()
 
-		t0 := Accelerate("tcp://:41501-41504,udp://:42401-42404", "tcp://127.0.0.1:5203", BACKEND)
+		t0, err := Accelerate("tcp://:41501-41504,udp://:42401-42404", "tcp://127.0.0.1:5203", BACKEND)
+		if err != nil {
+			t.Fatal(err)
+		}
 		t0.WaitforAlive()
-		t1 := Accelerate("tcp://:50500", "tcp://127.0.0.1:41501-41504,udp://127.0.0.1:42401-42404", FRONTEND)
+		t1, err := Accelerate("tcp://:50500", "tcp://127.0.0.1:41501-41504,udp://127.0.0.1:42401-42404", FRONTEND)
+		if err != nil {
+			t.Fatal(err)
+		}
 		t1.WaitforAlive()
 
 		//iperfExec(exec.Command("iperf3", "-c", "127.0.0.1", "-p", "50500", "-R", "-P", "3"))
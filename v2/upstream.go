@@ -1,48 +1,144 @@
 package trafcacc
 
 import (
+	"context"
 	"encoding/gob"
 	"errors"
+	"fmt"
 	"math/rand"
 	"net"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"golang.org/x/net/ipv4"
 )
 
 type upstream struct {
-	uuid  uint64
-	proto string
-	alive int64
-	grp   int
+	uuid   uint64
+	proto  string
+	alive  int64
+	grp    int
+	weight int
 
 	// status recorder
 	sent    uint64
 	recv    uint64
-	jitter  int64
-	latency int64
+	latency int64 // the last rtt sample
+	srtt    int64 // smoothed rtt
+	rttvar  int64 // rtt variation
+	loss    int64 // smoothed round trip loss rate in ppm
+	lossin  int64 // smoothed loss rate from peer in ppm
+	lossout int64 // smoothed loss rate to peer in ppm
+
+	// the last probe Stamp from peer and the local time it's received,
+	// [2]int64, echoed in the next probe sent
+	peerstamp atomic.Value
+
 	closed  int32
+	retired int32
+	down    int32
+	peer    uint32 // identity of the peer, server only
+
+	// failure detection by probes, see probed
+	dmux      sync.Mutex
+	failed    int32
+	misses    int
+	oks       int
+	holddown  int
+	recovered time.Time
+	ponged    int32 // pong received since last ping, dialer only
+
+	brk   breaker
+	sendq sendq
+	cc    congestion // udp only
+
+	// cmux guards conn, encoder and batch that are set by start and
+	// cleared by close while the writer uses them. The writer of a conn runs
+	// from start until stopwriter is called by close, ctx is done then.
+	cmux       sync.Mutex
+	ctx        context.Context
+	stopwriter context.CancelFunc
+	writers    sync.WaitGroup
+
+	// probes sent, the highest sequence and number of probes received, and
+	// the same counters of ours reported by peer. lastin and lastout are
+	// the sequence and number at the last loss sample.
+	probeseq, probetop, probegot uint64
+	peertop, peergot             uint64
+	lastin, lastout              [2]uint64
+
+	// delivery rate of what is sent on the upstream, by peer reported
+	// receive counter. bw is the max of the last bwwindow samples.
+	peerrecv     uint64
+	peerrecvtime int64
+	bwsamples    [bwwindow]int64
+	bwidx        int
+	bw           int64
+
+	// bytes sent when each of the last probes is sent, by Seq, and bytes
+	// sent up to a probe that is replied at once and received by peer
+	// then, [2]uint64. lastdelivered is the one at the last udp check.
+	probesent     [4]atomic.Value
+	delivered     atomic.Value
+	lastdelivered [2]uint64
 
 	// tcp only
 	encoder *gob.Encoder
 	decoder *gob.Decoder
 
-	// udp only (server)
+	// udp only (server), udpconn is shared by upstreams of the listener,
+	// udpaddr is *net.UDPAddr of peer
 	udpconn *net.UDPConn
-	udpaddr *net.UDPAddr
+	udpaddr atomic.Value
+	seen    int64 // when the last packet is received
+
+	// udp only, batch writes the packets of conn or udpconn, ms is used by
+	// the writer for it
+	batch batchconn
+	ms    []ipv4.Message
+
+	// random token that tells the path of dialer upstream apart, it's
+	// learned by server from ping
+	token uint64
 
 	// dialer only
-	conn net.Conn
-	addr string
+	conn   net.Conn
+	addr   string
+	bind   string
+	origin string // endpoint the addr resolved from
 }
 
 func newUpstream(proto string) *upstream {
 	return &upstream{
 		proto:  proto,
-		jitter: int64(^uint64(0) >> 1),
+		weight: 1,
+		sendq:  newSendq(),
+	}
+}
+
+// dial to u.addr from local address u.bind if it's set
+func (u *upstream) dial() (net.Conn, error) {
+	d := net.Dialer{}
+	if len(u.bind) > 0 {
+		bind := u.bind
+		if _, _, err := net.SplitHostPort(bind); err != nil {
+			bind = net.JoinHostPort(bind, "0")
+		}
+		var err error
+		switch u.proto {
+		case tcp:
+			d.LocalAddr, err = net.ResolveTCPAddr(u.proto, bind)
+		case udp:
+			d.LocalAddr, err = net.ResolveUDPAddr(u.proto, bind)
+		}
+		if err != nil {
+			return nil, err
+		}
 	}
+	return d.Dial(u.proto, u.addr)
 }
 
 func (u *upstream) send(cmd cmd) error {
@@ -50,16 +146,59 @@ func (u *upstream) send(cmd cmd) error {
 		Cmd:  cmd,
 		Time: time.Now().UnixNano(),
 	}
-	return u.sendpacket(p)
+	return u.enqueue(p, nil, false)
+}
+
+// sendprobe send ping or pong with probe of u, it echoes the last stamp
+// from peer so that peer can measure rtt on its own clock. The probe is
+// signed if key is set.
+func (u *upstream) sendprobe(cmd cmd, senderid uint32, flags uint64, key []byte) error {
+	now := time.Now().UnixNano()
+	pb := u.newprobe(now)
+	pb.Flags = flags
+	pb.sign(key, senderid)
+	p := &packet{
+		Senderid: senderid,
+		Cmd:      cmd,
+		Buf:      pb.encode(),
+		Time:     now,
+	}
+	return u.enqueue(p, nil, false)
+}
+
+// newprobe returns the next probe of u to send at now
+func (u *upstream) newprobe(now int64) probe {
+	pb := probe{
+		Grp:   uint32(u.grp),
+		Recv:  atomic.LoadUint64(&u.recv),
+		Stamp: now,
+		Seq:   atomic.AddUint64(&u.probeseq, 1),
+		Top:   atomic.LoadUint64(&u.probetop),
+		Got:   atomic.LoadUint64(&u.probegot),
+		Token: u.token,
+	}
+	if ps, ok := u.peerstamp.Load().([2]int64); ok {
+		pb.Echo, pb.Held = ps[0], now-ps[1]
+	}
+	u.probesent[pb.Seq%uint64(len(u.probesent))].Store([2]uint64{uint64(now), atomic.LoadUint64(&u.sent)})
+	return pb
 }
 
 func (u *upstream) sendpacket(p *packet) error {
 	atomic.AddUint64(&u.sent, uint64(len(p.Buf)))
 
+	u.cmux.Lock()
+	conn, encoder := u.conn, u.encoder
+	u.cmux.Unlock()
+
 	switch u.proto {
 	case tcp:
+		if conn == nil || encoder == nil {
+			return errUpstreamClosed
+		}
+		conn.SetWriteDeadline(time.Now().Add(sendtimeout))
 		p.lock.RLock()
-		err := u.encoder.Encode(p)
+		err := encoder.Encode(p)
 		p.lock.RUnlock()
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
@@ -71,7 +210,9 @@ func (u *upstream) sendpacket(p *packet) error {
 		return err
 	case udp:
 
-		udpbuf := make([]byte, buffersize)
+		b := getbuf()
+		defer putbuf(b)
+		udpbuf := *b
 
 		n := p.encode(udpbuf)
 		if n < 0 {
@@ -81,10 +222,10 @@ func (u *upstream) sendpacket(p *packet) error {
 			}).Warnln("send upstream cmd error")
 		}
 		var err error
-		if u.udpaddr != nil { // server
-			_, err = u.udpconn.WriteToUDP(udpbuf[:n], u.udpaddr)
-		} else if u.conn != nil { // dialer
-			_, err = u.conn.Write(udpbuf[:n])
+		if addr, ok := u.udpaddr.Load().(*net.UDPAddr); ok { // server
+			_, err = u.udpconn.WriteToUDP(udpbuf[:n], addr)
+		} else if conn != nil { // dialer
+			_, err = conn.Write(udpbuf[:n])
 		} else {
 			logrus.WithFields(logrus.Fields{
 				"upstream": u,
@@ -102,48 +243,323 @@ func (u *upstream) sendpacket(p *packet) error {
 	return errors.New("send to unknown upstream protocol")
 }
 
+// start u on conn and its writer, conn is nil for upstreams of udp
+// listener. The writer of the last conn is waited to quit first. Returns
+// false if u is retired.
+func (u *upstream) start(conn net.Conn) bool {
+	u.writers.Wait()
+
+	u.cmux.Lock()
+	defer u.cmux.Unlock()
+	if u.isRetired() {
+		return false
+	}
+	if conn != nil {
+		u.conn = conn
+		switch u.proto {
+		case tcp:
+			u.encoder = gob.NewEncoder(conn)
+			u.decoder = gob.NewDecoder(conn)
+		case udp:
+			if c, ok := conn.(*net.UDPConn); ok {
+				u.batch = newBatchConn(c)
+			}
+		}
+	}
+
+	u.ctx, u.stopwriter = context.WithCancel(context.Background())
+	atomic.StoreInt32(&u.closed, 0)
+	u.writers.Add(1)
+	go u.writeloop(u.ctx)
+	return true
+}
+
+// close conn of u and stop its writer, what is queued is kept for the
+// next start
 func (u *upstream) close() {
+	u.cmux.Lock()
+	defer u.cmux.Unlock()
 	if u.conn != nil {
 		u.conn.Close()
 		u.conn = nil
 	}
-	if u.udpconn != nil {
-		u.udpconn.Close()
-		u.udpconn = nil
+	if u.stopwriter != nil {
+		u.stopwriter()
+		u.stopwriter = nil
 	}
 	atomic.StoreInt32(&u.closed, 1)
 }
 
+// Proto of u, tcp or udp
+func (u *upstream) Proto() string {
+	return u.proto
+}
+
+// Group of u
+func (u *upstream) Group() int {
+	return u.grp
+}
+
+// Weight of u
+func (u *upstream) Weight() int {
+	return u.weight
+}
+
+// RTT returns smoothed rtt of u
+func (u *upstream) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&u.srtt))
+}
+
+// Bandwidth returns estimated delivery rate of u in bytes per second
+func (u *upstream) Bandwidth() uint64 {
+	return uint64(atomic.LoadInt64(&u.bw))
+}
+
+// Loss returns smoothed round trip loss rate of u
+func (u *upstream) Loss() float64 {
+	return float64(atomic.LoadInt64(&u.loss)) / 1e6
+}
+
+// LossIn returns smoothed loss rate of packets from peer on u
+func (u *upstream) LossIn() float64 {
+	return float64(atomic.LoadInt64(&u.lossin)) / 1e6
+}
+
+// LossOut returns smoothed loss rate of packets to peer on u
+func (u *upstream) LossOut() float64 {
+	return float64(atomic.LoadInt64(&u.lossout)) / 1e6
+}
+
+// updatertt with rtt sample r, smoothed like TCP does in RFC 6298
+func (u *upstream) updatertt(r int64) {
+	atomic.StoreInt64(&u.latency, r)
+
+	srtt := atomic.LoadInt64(&u.srtt)
+	if srtt == 0 {
+		atomic.StoreInt64(&u.srtt, r)
+		atomic.StoreInt64(&u.rttvar, r/2)
+		return
+	}
+	d := srtt - r
+	if d < 0 {
+		d = -d
+	}
+	rttvar := atomic.LoadInt64(&u.rttvar)
+	atomic.StoreInt64(&u.rttvar, rttvar+(d-rttvar)/4)
+	atomic.StoreInt64(&u.srtt, srtt+(r-srtt)/8)
+}
+
+// updateprobe with probe received from peer at now
+func (u *upstream) updateprobe(pb *probe, now int64) {
+	if pb.Stamp != 0 {
+		u.peerstamp.Store([2]int64{pb.Stamp, now})
+	}
+	if pb.Seq != 0 {
+		atomic.AddUint64(&u.probegot, 1)
+		if pb.Seq > atomic.LoadUint64(&u.probetop) {
+			atomic.StoreUint64(&u.probetop, pb.Seq)
+		}
+		atomic.StoreUint64(&u.peertop, pb.Top)
+		atomic.StoreUint64(&u.peergot, pb.Got)
+	}
+	if pb.Echo != 0 {
+		if pb.Held < int64(pinginterval/2) {
+			u.updatedelivered(pb)
+		}
+		if r := now - pb.Echo - pb.Held; r > 0 {
+			u.updatertt(r)
+			if u.proto == udp {
+				u.cc.updaterate(u, r, now)
+			}
+		}
+	}
+	u.updatebw(pb.Recv)
+}
+
+// updateloss of both directions once there are losswindow probes since last
+// sample, probes in flight are counted in the next sample
+func (u *upstream) updateloss() {
+	in := lossample(&u.lastin, &u.lossin, atomic.LoadUint64(&u.probetop), atomic.LoadUint64(&u.probegot))
+	out := lossample(&u.lastout, &u.lossout, atomic.LoadUint64(&u.peertop), atomic.LoadUint64(&u.peergot))
+	if in || out {
+		lossin := atomic.LoadInt64(&u.lossin)
+		lossout := atomic.LoadInt64(&u.lossout)
+		atomic.StoreInt64(&u.loss, 1e6-(1e6-lossin)*(1e6-lossout)/1e6)
+	}
+}
+
+// lossample update loss with probes sent up to seq and got by the receiver
+// since last, returns false if there is not enough probes
+func lossample(last *[2]uint64, loss *int64, seq, got uint64) bool {
+	if seq < last[0] || got < last[1] {
+		// counters of peer restarted
+		*last = [2]uint64{seq, got}
+		return false
+	}
+	sent, recv := seq-last[0], got-last[1]
+	if sent < losswindow {
+		return false
+	}
+	*last = [2]uint64{seq, got}
+	if recv > sent {
+		recv = sent
+	}
+
+	sample := int64((sent - recv) * 1e6 / sent)
+	l := atomic.LoadInt64(loss)
+	atomic.StoreInt64(loss, l+(sample-l)/4)
+	return true
+}
+
+// lossMeasured returns true if there is loss sample of u
+func (u *upstream) lossMeasured() bool {
+	return u.lastin[0] != 0 || u.lastout[0] != 0
+}
+
+// updatebw with bytes peer received from u, it's called by the reader of u
+func (u *upstream) updatebw(recv uint64) {
+	now := time.Now().UnixNano()
+	if u.peerrecvtime != 0 && recv >= u.peerrecv && now > u.peerrecvtime {
+		u.bwsamples[u.bwidx%bwwindow] = int64(recv-u.peerrecv) * int64(time.Second) / (now - u.peerrecvtime)
+		u.bwidx++
+
+		var max int64
+		for _, v := range u.bwsamples {
+			if v > max {
+				max = v
+			}
+		}
+		atomic.StoreInt64(&u.bw, max)
+	}
+	u.peerrecv, u.peerrecvtime = recv, now
+}
+
+// probed record a probe received or missed. u is marked failed after
+// detectmult probes in a row are missed, and recovers after holddown probes
+// in a row received, so that flapping upstream stays out longer.
+func (u *upstream) probed(ok bool) {
+	u.dmux.Lock()
+	defer u.dmux.Unlock()
+
+	failed := atomic.LoadInt32(&u.failed) != 0
+	if ok {
+		u.misses = 0
+		if failed {
+			if u.oks++; u.oks >= u.holddown {
+				u.oks = 0
+				u.recovered = time.Now()
+				atomic.StoreInt32(&u.failed, 0)
+				logrus.WithFields(logrus.Fields{
+					"proto":    u.proto,
+					"addr":     u.addr,
+					"holddown": u.holddown,
+				}).Infoln("upstream recovered")
+			}
+		}
+		return
+	}
+
+	u.oks = 0
+	if u.misses++; !failed && u.misses >= detectmult {
+		if !u.recovered.IsZero() && time.Since(u.recovered) < flapwindow {
+			u.holddown *= 2
+			if u.holddown > holddownmax {
+				u.holddown = holddownmax
+			}
+		} else {
+			u.holddown = holddownmin
+		}
+		atomic.StoreInt32(&u.failed, 1)
+		logrus.WithFields(logrus.Fields{
+			"proto":    u.proto,
+			"addr":     u.addr,
+			"misses":   u.misses,
+			"holddown": u.holddown,
+		}).Warnln("upstream failed")
+	}
+}
+
+// silent returns true if no probe is received from peer in detectmult
+// pinginterval since it's connected
+func (u *upstream) silent() bool {
+	alive := atomic.LoadInt64(&u.alive)
+	return alive != 0 && time.Duration(time.Now().UnixNano()-alive) > pinginterval*detectmult
+}
+
+func (u *upstream) isFailed() bool {
+	return atomic.LoadInt32(&u.failed) != 0
+}
+
+// updatedelivered with probe that replied at once to a probe of ours, what
+// peer received then is what we had sent by the time of ours minus loss
+func (u *upstream) updatedelivered(pb *probe) {
+	for i := range u.probesent {
+		if ps, ok := u.probesent[i].Load().([2]uint64); ok && ps[0] == uint64(pb.Echo) {
+			u.delivered.Store([2]uint64{ps[1], pb.Recv})
+			return
+		}
+	}
+}
+
+func (u *upstream) isRetired() bool {
+	return atomic.LoadInt32(&u.retired) != 0
+}
+
 func (u *upstream) isAlive() bool {
 	return atomic.LoadInt32(&u.closed) == 0 &&
-		atomic.LoadInt64(&u.latency) < int64(time.Second) &&
+		!u.isRetired() &&
+		!u.isFailed() &&
+		atomic.LoadInt64(&u.srtt) < int64(time.Second) &&
 		keepalive > time.Duration(time.Now().UnixNano()-atomic.LoadInt64(&u.alive))
 }
 
 type streampool struct {
 	*sync.RWMutex
+	peer     uint32 // identity of the peer, server only
 	pool     []*upstream
 	atomicid uint64
 	alive    int32
 	wg       sync.WaitGroup
 
-	// for pick up streams
-	tcpool                 []*upstream
-	udpool                 []*upstream
-	alived                 []*upstream
-	tcplen, udplen, alvlen int
+	// for pick up streams, alive upstreams ranked from the best to the worst
+	paths     []Path
+	scheduler Scheduler
+
+	// half-open upstreams that take trial copies of packets
+	trials []*upstream
+
+	// udp paths are not picked while udpblocked. dialer decides it by the
+	// delivery of udp data since last check, server follows the dialer.
+	udpblocked       bool
+	udpfollow        bool
+	udpreason        string
+	udpsince         time.Time
+	udpsent, udprecv uint64
+
+	// redundancy factor adjusted by measured loss, and why it's changed
+	copies       int
+	copiesreason string
+	lowsince     time.Time
 
 	// write
-	rn    uint32
 	cache *writeCache
+
+	// updateloop quits once ctx is done, see stop
+	ctx  context.Context
+	stop context.CancelFunc
 }
 
-func newStreamPool() *streampool {
+// newStreamPool returns a pool updated until ctx is done or it's stopped
+func newStreamPool(ctx context.Context) *streampool {
 	pl := &streampool{
 		// use RWMutex
-		RWMutex: &sync.RWMutex{},
-		cache:   newWriteCache(),
+		RWMutex:      &sync.RWMutex{},
+		cache:        newWriteCache(),
+		scheduler:    NewRedundantScheduler(),
+		copies:       2,
+		copiesreason: "loss not measured",
 	}
+	pl.ctx, pl.stop = context.WithCancel(ctx)
 
 	go pl.updateloop()
 	return pl
@@ -155,64 +571,98 @@ func (pool *streampool) append(u *upstream, grp int) {
 		pool.Unlock()
 	}()
 
-	if u.uuid != 0 {
-		for _, v := range pool.pool {
-			if v.uuid == u.uuid {
-				return
-			}
+	for _, v := range pool.pool {
+		if v == u {
+			return
 		}
 	}
 	u.uuid = atomic.AddUint64(&pool.atomicid, 1)
 	u.grp = grp
 	pool.pool = append(pool.pool, u)
-
-	pool.tcpool = pool.ensureCap(pool.tcpool)
-	pool.udpool = pool.ensureCap(pool.udpool)
-	pool.alived = pool.ensureCap(pool.alived)
 }
 
-func (pool *streampool) ensureCap(pl []*upstream) []*upstream {
-	if cap(pl) < len(pool.pool) {
-		ups := make([]*upstream, cap(pl)+10)
-		for k, v := range pl {
-			ups[k] = v
-		}
-		return ups
-	}
-	return pl
+func (pool *streampool) setScheduler(s Scheduler) {
+	pool.Lock()
+	pool.scheduler = s
+	pool.Unlock()
 }
 
-func (pool *streampool) pickupstreams(udp bool) []*upstream {
+func (pool *streampool) pickupstreams(p *packet) []*upstream {
 	pool.waitforalive()
 
-	// pick udp and tcp equally
 	pool.RLock()
 	defer pool.RUnlock()
 
-	// pick one of each
+	p.lock.RLock()
+	sentby := p.sentby
+	p.lock.RUnlock()
 
-	switch {
-	case udp && pool.udplen > 0:
-		rn := int(atomic.AddUint32(&pool.rn, 1) - 1)
-		return []*upstream{pool.udpool[rn%pool.udplen]}
-	case pool.tcplen > 0 && pool.udplen > 0:
-		// pick one of each
-		rn := int(atomic.AddUint32(&pool.rn, 1) - 1)
-		return []*upstream{
-			pool.udpool[rn%pool.udplen],
-			pool.tcpool[rn%pool.tcplen],
+	info := PacketInfo{
+		Control:    p.Cmd != data,
+		UDP:        p.udp,
+		Size:       len(p.Buf),
+		Copies:     pool.copies,
+		Retransmit: len(sentby) > 0,
+	}
+	// control packets are not retransmitted like data
+	if info.Control && info.Copies < 2 {
+		info.Copies = 2
+	}
+
+	// paths is shared with other picks, scheduler only reads it
+	paths := pool.paths
+	if info.Retransmit {
+		paths = disjoint(paths, sentby)
+	}
+
+	var ups []*upstream
+	for _, v := range pool.scheduler.Pick(info, paths) {
+		if u, ok := v.(*upstream); ok {
+			ups = append(ups, u)
 		}
-	case pool.tcplen == 0 || pool.udplen == 0:
-		// pick 2 alived
-		rn := int(atomic.AddUint32(&pool.rn, 2) - 2)
+	}
+	if len(ups) == 0 {
+		logrus.Warnln("no upstream avalible for pick")
+	}
+	return ups
+}
 
-		return []*upstream{
-			pool.alived[rn%pool.alvlen],
-			pool.alived[(rn+1)%pool.alvlen],
+// disjoint returns paths in groups that the packet was not sent on, or the
+// paths it was not sent on, or all of them if there is none
+func disjoint(paths []Path, sentby []*upstream) []Path {
+	sent := upstreamPaths(sentby)
+	var others, samegroup []Path
+	for _, v := range paths {
+		switch {
+		case hasPath(sent, v):
+		case hasGroup(sent, v.Group()):
+			samegroup = append(samegroup, v)
+		default:
+			others = append(others, v)
 		}
 	}
-	logrus.Warnln("no upstream avalible for pick")
-	return nil
+	if len(others) > 0 {
+		return others
+	}
+	if len(samegroup) > 0 {
+		return samegroup
+	}
+	return paths
+}
+
+func upstreamPaths(ups []*upstream) []Path {
+	paths := make([]Path, len(ups))
+	for i, u := range ups {
+		paths[i] = u
+	}
+	return paths
+}
+
+// setgroup of u to grp reported by peer
+func (pool *streampool) setgroup(u *upstream, grp int) {
+	pool.Lock()
+	u.grp = grp
+	pool.Unlock()
 }
 
 func (pool *streampool) waitforalive() {
@@ -230,34 +680,54 @@ func (pool *streampool) updateloop() {
 	for {
 		pool.updatealive()
 
+		wait := time.Millisecond * 200
 		if atomic.LoadInt32(&pool.alive) != 0 {
-			<-time.After(time.Second)
-		} else {
-			<-time.After(time.Millisecond * 200)
+			wait = time.Second
+		}
+		select {
+		case <-time.After(wait):
+		case <-pool.ctx.Done():
+			return
 		}
 	}
 }
 
-// check if there is any alive upstream
+// check if there is any alive upstream, and rank them for scheduler
 func (pool *streampool) updatealive() (updated bool) {
 	pool.Lock()
 	defer pool.Unlock()
-	var tcpidx, udpidx, aliveidx int
+
+	paths := make([]Path, 0, len(pool.pool))
+	var trials []*upstream
 	for _, v := range pool.pool {
-		if v.isAlive() {
-			switch v.proto {
-			case tcp:
-				pool.tcpool[tcpidx] = v
-				tcpidx++
-			case udp:
-				pool.udpool[udpidx] = v
-				udpidx++
-			}
-			pool.alived[aliveidx] = v
-			aliveidx++
+		v.updateloss()
+		if v.silent() {
+			v.probed(false)
+		}
+		v.brk.check(v)
+		if !v.isAlive() {
+			continue
 		}
+		switch v.brk.current() {
+		case breakerClosed:
+			paths = append(paths, v)
+		case breakerHalfOpen:
+			trials = append(trials, v)
+		}
+	}
+	// half-open upstreams are better than nothing
+	if len(paths) == 0 {
+		for _, v := range trials {
+			paths = append(paths, v)
+		}
+		trials = nil
 	}
-	if aliveidx > 0 {
+
+	pool.checkudp()
+	if pool.udpblocked {
+		paths = dropudp(paths)
+	}
+	if len(paths) > 0 {
 		if atomic.LoadInt32(&pool.alive) == 0 {
 			updated = true
 			atomic.StoreInt32(&pool.alive, 1)
@@ -268,53 +738,241 @@ func (pool *streampool) updatealive() (updated bool) {
 			atomic.StoreInt32(&pool.alive, 0)
 		}
 	}
-	pool.tcplen = tcpidx
-	pool.udplen = udpidx
-	pool.alvlen = aliveidx
 
-	if updated {
-		pool.shuffle(pool.tcpool, pool.tcplen)
-		pool.shuffle(pool.udpool, pool.udplen)
-		pool.shuffle(pool.alived, pool.alvlen)
+	// shuffle so that paths of equal score are not always in the same order
+	for i := range paths {
+		j := rand.Intn(i + 1)
+		paths[i], paths[j] = paths[j], paths[i]
 	}
+	rank(paths)
+	pool.paths = paths
+	pool.trials = trials
+	pool.adaptcopies(paths)
 	return
 }
 
-func (pool *streampool) shuffle(arr []*upstream, l int) {
-	for i := 0; i < l; i++ {
-		j := rand.Intn(i + 1)
-		arr[i], arr[j] = arr[j], arr[i]
+// checkudp block udp if delivery of udp data is below udpdelivery while tcp
+// is healthy, and unblock it after udpreprobe to see if it's back
+func (pool *streampool) checkudp() {
+	var tcpok bool
+	for _, v := range pool.pool {
+		if v.proto == tcp {
+			tcpok = tcpok || (v.isAlive() && v.brk.current() == breakerClosed)
+			continue
+		}
+		d, ok := v.delivered.Load().([2]uint64)
+		if !ok {
+			continue
+		}
+		last := v.lastdelivered
+		v.lastdelivered = d
+		if d[0] < last[0] || d[1] < last[1] {
+			// counters of peer restarted
+			continue
+		}
+		sent, recv := d[0]-last[0], d[1]-last[1]
+		if recv > sent {
+			recv = sent
+		}
+		pool.udpsent += sent
+		pool.udprecv += recv
+	}
+	if pool.udpfollow {
+		return
+	}
+
+	switch {
+	case pool.udpblocked && !tcpok:
+		pool.setudp(false, "tcp paths down")
+	case pool.udpblocked && time.Since(pool.udpsince) >= udpreprobe:
+		pool.setudp(false, "re-probe")
+	case !pool.udpblocked && pool.udpsent >= udpwindow:
+		delivery := float64(pool.udprecv) / float64(pool.udpsent)
+		pool.udpsent, pool.udprecv = 0, 0
+		if delivery < udpdelivery && tcpok {
+			pool.setudp(true, fmt.Sprintf("udp delivery %.0f%%", delivery*100))
+		}
+	}
+	if pool.udpblocked {
+		pool.udpsent, pool.udprecv = 0, 0
 	}
 }
 
+func (pool *streampool) setudp(blocked bool, reason string) {
+	if blocked == pool.udpblocked {
+		return
+	}
+	pool.udpblocked, pool.udpreason, pool.udpsince = blocked, reason, time.Now()
+	pool.udpsent, pool.udprecv = 0, 0
+	if blocked {
+		logrus.WithField("reason", reason).Warnln("udp blocked, fall back to tcp")
+	} else {
+		logrus.WithField("reason", reason).Infoln("udp unblocked")
+	}
+}
+
+// followudp set udp mode as dialer does, it's called by server
+func (pool *streampool) followudp(blocked bool) {
+	pool.Lock()
+	changed := !pool.udpfollow || blocked != pool.udpblocked
+	pool.udpfollow = true
+	pool.setudp(blocked, "follow dialer")
+	pool.Unlock()
+
+	if changed {
+		pool.updatealive()
+	}
+}
+
+// probeflags returns flags of ping that dialer sends
+func (pool *streampool) probeflags() (flags uint64) {
+	pool.RLock()
+	if pool.udpblocked {
+		flags |= probeUDPBlocked
+	}
+	pool.RUnlock()
+	return
+}
+
+// udpmode returns the udp mode and the reason it's changed
+func (pool *streampool) udpmode() string {
+	pool.RLock()
+	defer pool.RUnlock()
+	if pool.udpblocked {
+		return "blocked (" + pool.udpreason + ")"
+	}
+	return "ok"
+}
+
+// dropudp returns paths without udp ones unless there is no other path
+func dropudp(paths []Path) []Path {
+	var tcps []Path
+	for _, v := range paths {
+		if v.Proto() != udp {
+			tcps = append(tcps, v)
+		}
+	}
+	if len(tcps) == 0 {
+		return paths
+	}
+	return tcps
+}
+
+// adaptcopies adjust redundancy factor by the worst loss of packets sent on
+// alive paths. It's raised at once and lowered only after loss stayed low
+// for copieshold.
+func (pool *streampool) adaptcopies(paths []Path) {
+	var worst Path
+	for _, v := range paths {
+		// skip upstream that has no loss sample yet
+		if u, ok := v.(*upstream); ok && !u.lossMeasured() {
+			continue
+		}
+		if worst == nil || v.LossOut() > worst.LossOut() {
+			worst = v
+		}
+	}
+
+	var copies int
+	var reason string
+	switch {
+	case worst == nil:
+		copies, reason = 2, "loss not measured"
+	case worst.LossOut() >= lossspike:
+		copies, reason = 3, fmt.Sprintf("loss %.1f%% on %s path of group %d", worst.LossOut()*100, worst.Proto(), worst.Group())
+	case worst.LossOut() >= lossclean:
+		copies, reason = 2, fmt.Sprintf("loss %.1f%% on %s path of group %d", worst.LossOut()*100, worst.Proto(), worst.Group())
+	default:
+		copies, reason = 1, "all paths clean"
+	}
+
+	if copies >= pool.copies {
+		pool.lowsince = time.Time{}
+	} else {
+		if pool.lowsince.IsZero() {
+			pool.lowsince = time.Now()
+		}
+		if time.Since(pool.lowsince) < copieshold {
+			return
+		}
+		pool.lowsince = time.Time{}
+	}
+	if copies == pool.copies {
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"from":   pool.copies,
+		"to":     copies,
+		"reason": reason,
+	}).Infoln("redundancy factor changed")
+	pool.copies, pool.copiesreason = copies, reason
+}
+
+// rank sort paths from the best to the worst
+func rank(paths []Path) {
+	scores := make(map[Path]int64, len(paths))
+	for _, v := range paths {
+		scores[v] = pathScore(v)
+	}
+	sort.SliceStable(paths, func(i, j int) bool {
+		return scores[paths[i]] < scores[paths[j]]
+	})
+}
+
 func (pool *streampool) remove(u *upstream) {
 	pool.Lock()
 	for k, v := range pool.pool {
-		if v.uuid == u.uuid {
+		if v == u {
 			pool.pool = append(pool.pool[:k], pool.pool[k+1:]...)
+			break
 		}
 	}
 	pool.Unlock()
 }
 
+// drain stop picking u for new packets, then remove it from the pool and
+// close it after in-flight packets and retransmits had a chance to go out
+func (pool *streampool) drain(u *upstream) {
+	atomic.StoreInt32(&u.retired, 1)
+	pool.updatealive()
+
+	<-time.After(draintime)
+
+	pool.remove(u)
+	u.close()
+}
+
+// picktrials returns half-open upstreams that are due for a trial copy
+func (pool *streampool) picktrials() (ups []*upstream) {
+	pool.RLock()
+	defer pool.RUnlock()
+	for _, u := range pool.trials {
+		if u.brk.trytrial() {
+			ups = append(ups, u)
+		}
+	}
+	return
+}
+
 func (pool *streampool) write(p *packet) {
 
-	// pick upstream tunnel and send packet
-	for _, u := range pool.pickupstreams(p.udp) {
-		go func(up *upstream) {
-			err := up.sendpacket(p)
-			if err != nil {
-				logrus.WithFields(logrus.Fields{
-					"error": err,
-				}).Warnln("encode packet to upstream errror")
-				up.close()
-			}
-		}(u)
+	// pick upstream tunnel and send packet, and trial copies
+	ups := pool.pickupstreams(p)
+	p.lock.Lock()
+	// only the first send waits for room in queue, not retransmit
+	wait := len(p.sentby) == 0
+	p.sentby = append(p.sentby, ups...)
+	if len(p.sentby) > maxsentby {
+		p.sentby = p.sentby[len(p.sentby)-maxsentby:]
 	}
+	p.lock.Unlock()
 
-	// put packet in cache
-	if p.Cmd == data {
-		pool.cache.add(p)
+	for _, u := range ups {
+		u.enqueue(p, pool, wait)
+	}
+	for _, u := range pool.picktrials() {
+		u.enqueue(p, pool, false)
 	}
 
 	return
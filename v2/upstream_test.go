@@ -0,0 +1,331 @@
+package trafcacc
+
+import (
+	"context"
+	"encoding/gob"
+	"net"
+	"testing"
+	"time"
+)
+
+func testPool(ups ...*upstream) *streampool {
+	pool := newStreamPool(context.Background())
+	for _, u := range ups {
+		u.alive = time.Now().UnixNano()
+		pool.append(u, u.grp)
+	}
+	pool.updatealive()
+	return pool
+}
+
+func testUpstream(proto string, grp int) *upstream {
+	u := newUpstream(proto)
+	u.grp = grp
+	return u
+}
+
+func TestPickupstreamsGroups(t *testing.T) {
+	pool := testPool(
+		testUpstream(udp, 1), testUpstream(udp, 1), testUpstream(udp, 1),
+		testUpstream(udp, 2), testUpstream(tcp, 1), testUpstream(tcp, 2),
+	)
+
+	for i := 0; i < 100; i++ {
+		ups := pool.pickupstreams(&packet{})
+		if len(ups) != 2 || ups[0].grp == ups[1].grp {
+			t.Fatal("redundant copies picked in the same group", ups[0].grp, ups[1].grp)
+		}
+	}
+}
+
+func TestPickupstreamsOneGroup(t *testing.T) {
+	pool := testPool(testUpstream(tcp, 1), testUpstream(tcp, 1))
+
+	for i := 0; i < 10; i++ {
+		ups := pool.pickupstreams(&packet{})
+		if len(ups) != 2 || ups[0] == ups[1] {
+			t.Fatal("expect two different upstreams in one group")
+		}
+	}
+}
+
+func TestPickupstreamsLatency(t *testing.T) {
+	slow := testUpstream(tcp, 1)
+	slow.srtt = int64(80 * time.Millisecond)
+	fast := testUpstream(tcp, 1)
+	fast.srtt = int64(20 * time.Millisecond)
+	lossy := testUpstream(tcp, 2)
+	lossy.srtt = int64(10 * time.Millisecond)
+	lossy.lossout = 500000
+	other := testUpstream(tcp, 2)
+	other.srtt = int64(40 * time.Millisecond)
+
+	pool := testPool(slow, fast, lossy, other)
+
+	for i := 0; i < 10; i++ {
+		ups := pool.pickupstreams(&packet{})
+		if len(ups) != 2 || ups[0] != fast || ups[1] != other {
+			t.Fatal("expect the fastest upstream and the fastest of another group")
+		}
+	}
+}
+
+func TestAdaptCopies(t *testing.T) {
+	clean := testUpstream(udp, 1)
+	clean.probetop, clean.probegot = losswindow, losswindow
+	clean.lastin = [2]uint64{losswindow, losswindow}
+	lossy := testUpstream(udp, 2)
+	lossy.probetop, lossy.probegot = losswindow, losswindow
+	lossy.lastin = [2]uint64{losswindow, losswindow}
+	lossy.lossout = 100000
+
+	pool := testPool(clean, lossy)
+	if pool.copies != 3 {
+		t.Fatal("expect 3 copies on loss spike, got", pool.copies, pool.copiesreason)
+	}
+	if ups := pool.pickupstreams(&packet{}); len(ups) != 2 {
+		t.Fatal("expect all 2 paths picked, got", len(ups))
+	}
+
+	// lowered only after loss stayed low for copieshold
+	lossy.lossout = 0
+	pool.updatealive()
+	if pool.copies != 3 {
+		t.Fatal("expect 3 copies within copieshold, got", pool.copies)
+	}
+	pool.lowsince = time.Now().Add(-copieshold)
+	pool.updatealive()
+	if pool.copies != 1 {
+		t.Fatal("expect 1 copy when all paths are clean, got", pool.copies, pool.copiesreason)
+	}
+	if ups := pool.pickupstreams(&packet{Cmd: data}); len(ups) != 1 {
+		t.Fatal("expect data sent once, got", len(ups))
+	}
+	if ups := pool.pickupstreams(&packet{Cmd: connect}); len(ups) != 2 {
+		t.Fatal("expect control packet sent twice, got", len(ups))
+	}
+}
+
+func TestUpdateProbeRTT(t *testing.T) {
+	u := testUpstream(udp, 1)
+	now := time.Now().UnixNano()
+
+	// echo of our stamp sent 30ms ago and held by peer for 10ms
+	u.updateprobe(&probe{Stamp: 1, Echo: now - int64(30*time.Millisecond), Held: int64(10 * time.Millisecond)}, now)
+	if u.RTT() != 20*time.Millisecond || u.rttvar != int64(10*time.Millisecond) {
+		t.Fatal("unexpected rtt", u.RTT(), time.Duration(u.rttvar))
+	}
+
+	u.updateprobe(&probe{Stamp: 2, Echo: now - int64(60*time.Millisecond)}, now)
+	if u.RTT() != 25*time.Millisecond || u.latency != int64(60*time.Millisecond) {
+		t.Fatal("unexpected rtt", u.RTT(), time.Duration(u.latency))
+	}
+
+	// peer stamp is echoed with the time it's held
+	if ps, ok := u.peerstamp.Load().([2]int64); !ok || ps != [2]int64{2, now} {
+		t.Fatal("unexpected peer stamp", ps)
+	}
+}
+
+func TestUpdateLoss(t *testing.T) {
+	a := testUpstream(udp, 1)
+	b := testUpstream(udp, 1)
+
+	// every 4th probe from a to b is lost, none from b to a
+	for i := 0; i < losswindow*4; i++ {
+		now := time.Now().UnixNano()
+		pb := a.newprobe(now)
+		if i%4 != 3 {
+			b.updateprobe(&pb, now)
+		}
+		pb = b.newprobe(now)
+		a.updateprobe(&pb, now)
+	}
+	a.updateloss()
+	b.updateloss()
+
+	if a.LossOut() == 0 || a.LossIn() != 0 {
+		t.Fatal("unexpected loss of a", a.LossIn(), a.LossOut())
+	}
+	if b.LossIn() == 0 || b.LossOut() != 0 {
+		t.Fatal("unexpected loss of b", b.LossIn(), b.LossOut())
+	}
+	if a.Loss() != a.LossOut() || b.Loss() != b.LossIn() {
+		t.Fatal("unexpected round trip loss", a.Loss(), b.Loss())
+	}
+}
+
+func TestProbedDampening(t *testing.T) {
+	u := testUpstream(udp, 1)
+	miss := func(n int) {
+		for i := 0; i < n; i++ {
+			u.probed(false)
+		}
+	}
+	recv := func(n int) {
+		for i := 0; i < n; i++ {
+			u.probed(true)
+		}
+	}
+
+	miss(detectmult - 1)
+	recv(1)
+	miss(detectmult - 1)
+	if u.isFailed() {
+		t.Fatal("expect misses not in a row are tolerated")
+	}
+	miss(1)
+	if !u.isFailed() {
+		t.Fatal("expect failed after", detectmult, "misses in a row")
+	}
+
+	recv(holddownmin - 1)
+	miss(1)
+	recv(holddownmin - 1)
+	if !u.isFailed() {
+		t.Fatal("expect recovery needs", holddownmin, "probes in a row")
+	}
+	recv(1)
+	if u.isFailed() {
+		t.Fatal("expect recovered")
+	}
+
+	// fails again shortly after recovery, holddown doubles
+	miss(detectmult)
+	recv(holddownmin)
+	if !u.isFailed() || u.holddown != holddownmin*2 {
+		t.Fatal("expect flapping upstream held down longer", u.holddown)
+	}
+	recv(holddownmin)
+	if u.isFailed() {
+		t.Fatal("expect recovered after doubled holddown")
+	}
+}
+
+func TestUDPFallback(t *testing.T) {
+	u := testUpstream(udp, 1)
+	peer := testUpstream(udp, 1)
+	tc := testUpstream(tcp, 2)
+	pool := testPool(u, tc)
+
+	// peer replies at once to a probe sent after udpwindow bytes, but got
+	// only a quarter of them
+	u.sent = udpwindow
+	now := time.Now().UnixNano()
+	pb := u.newprobe(now)
+	peer.updateprobe(&pb, now)
+	peer.recv = udpwindow / 4
+	pb = peer.newprobe(now)
+	u.updateprobe(&pb, now)
+
+	pool.updatealive()
+	if !pool.udpblocked || pool.probeflags()&probeUDPBlocked == 0 {
+		t.Fatal("expect udp blocked", pool.udpmode())
+	}
+	for i := 0; i < 10; i++ {
+		if ups := pool.pickupstreams(&packet{udp: true}); len(ups) != 1 || ups[0] != tc {
+			t.Fatal("expect tcp only while udp is blocked")
+		}
+	}
+
+	pool.udpsince = time.Now().Add(-udpreprobe)
+	pool.updatealive()
+	if pool.udpblocked {
+		t.Fatal("expect udp re-probed", pool.udpmode())
+	}
+	if ups := pool.pickupstreams(&packet{udp: true}); len(ups) != 1 || ups[0] != u {
+		t.Fatal("expect udp picked after re-probe")
+	}
+}
+
+func TestPickupstreamsRetransmit(t *testing.T) {
+	a1, a2 := testUpstream(udp, 1), testUpstream(udp, 1)
+	b1, b2 := testUpstream(udp, 2), testUpstream(udp, 2)
+	pool := testPool(a1, a2, b1, b2)
+
+	p := &packet{Cmd: data, sentby: []*upstream{a1}}
+	for i := 0; i < 10; i++ {
+		for _, u := range pool.pickupstreams(p) {
+			if u.grp != 2 {
+				t.Fatal("expect retransmit on the other group")
+			}
+		}
+	}
+
+	p.sentby = []*upstream{a1, b1, b2}
+	for i := 0; i < 10; i++ {
+		if ups := pool.pickupstreams(p); len(ups) != 1 || ups[0] != a2 {
+			t.Fatal("expect retransmit on the upstream it's not sent on")
+		}
+	}
+
+	// upstreams are recorded when written
+	ln, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	for _, u := range []*upstream{a1, a2, b1, b2} {
+		if u.conn, err = net.Dial("udp", ln.LocalAddr().String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p = &packet{Cmd: data}
+	pool.write(p)
+	if len(p.sentby) != 2 {
+		t.Fatal("expect sent upstreams recorded", len(p.sentby))
+	}
+}
+
+func TestSendq(t *testing.T) {
+	// net.Pipe is not buffered, nothing is dropped while written
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	u := testUpstream(tcp, 1)
+
+	// the queue is filled up before the writer starts
+	for i := 0; i < sendqdata+1; i++ {
+		u.enqueue(&packet{Cmd: data, Connid: uint32(i)}, nil, false)
+	}
+	for i := 0; i < sendqctrl+1; i++ {
+		u.enqueue(&packet{Cmd: ack, Connid: uint32(i)}, nil, false)
+	}
+	if u.sendq.dropped != 2 || u.sendq.len() != sendqdata+sendqctrl {
+		t.Fatal("expect a data and a control packet dropped", u.sendq.dropped, u.sendq.len())
+	}
+
+	got := make(chan *packet, sendqdata+sendqctrl)
+	go func() {
+		dec := gob.NewDecoder(c2)
+		for {
+			p := &packet{}
+			if dec.Decode(p) != nil {
+				return
+			}
+			got <- p
+		}
+	}()
+
+	u.start(c1)
+	defer u.close()
+
+	// control packets go first, the oldest one is dropped
+	for i := 0; i < sendqctrl+sendqdata; i++ {
+		var p *packet
+		select {
+		case p = <-got:
+		case <-time.After(time.Second):
+			t.Fatal("expect", sendqctrl+sendqdata, "packets, got", i)
+		}
+		if i < sendqctrl && (p.Cmd != ack || p.Connid != uint32(i+1)) {
+			t.Fatal("expect control packet", i+1, "got", p.Cmd, p.Connid)
+		}
+		if i >= sendqctrl && (p.Cmd != data || p.Connid != uint32(i-sendqctrl)) {
+			t.Fatal("expect data packet", i-sendqctrl, "got", p.Cmd, p.Connid)
+		}
+	}
+	if u.sendq.len() != 0 {
+		t.Fatal("expect queue drained")
+	}
+}